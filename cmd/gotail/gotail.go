@@ -5,52 +5,143 @@ package main
 import (
 	"flag"
 	"fmt"
-	"github.com/fw42/go-tail"
+	"github.com/ActiveState/tail"
+	"io"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 )
 
-func args2config() tail.Config {
-	config := tail.Config{Follow: true}
-	flag.IntVar(&config.Location, "n", 0, "tail from the last (N-1)th byte offset location (use negative value to tail from start of file)")
-	flag.BoolVar(&config.Follow, "f", false, "wait for additional data to be appended to the file")
-	flag.BoolVar(&config.ReOpen, "F", false, "follow, and track file rename/rotation")
-	flag.BoolVar(&config.Poll, "p", false, "use polling, instead of inotify")
-	flag.Parse()
+// prefix is set to prepend each line with the name of its file.
+var prefix bool
+
+// outMu serializes writing lines from multiple files.
+var outMu sync.Mutex
+
+// stopTimeout is how long the lines being read are given to be
+// printed once interrupted.
+const stopTimeout = time.Second
+
+// args2config parses the command line arguments into a tail
+// configuration and the files to tail. Errors are reported to stderr
+// along with the usage.
+func args2config(args []string) (tail.Config, []string, error) {
+	var config tail.Config
+	flags := flag.NewFlagSet("gotail", flag.ContinueOnError)
+	flags.IntVar(&config.NLines, "n", 10, "tail from the last N lines (use 0 to tail from the end)")
+	flags.IntVar(&config.Location, "c", 0, "tail from the last N bytes (use 0 to tail from the end, and -1 from the start of file)")
+	flags.BoolVar(&config.Follow, "f", false, "wait for additional data to be appended to the file")
+	flags.BoolVar(&config.ReOpen, "F", false, "follow, and track file rename/rotation")
+	flags.BoolVar(&config.Poll, "p", false, "use polling, instead of inotify")
+	flags.BoolVar(&prefix, "prefix", false, "prefix each line with the name of its file")
+	if err := flags.Parse(args); err != nil {
+		return config, nil, err
+	}
+	// Like tail(1), the last lines are only defaulted to if no byte
+	// offset is asked for instead.
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if set["c"] && !set["n"] {
+		config.NLines = 0
+	}
+	if config.NLines < 0 {
+		err := fmt.Errorf("invalid number of lines: %d", config.NLines)
+		fmt.Fprintln(flags.Output(), err)
+		flags.Usage()
+		return config, nil, err
+	}
 	if config.ReOpen {
 		config.Follow = true
 	}
-	return config
+	return config, flags.Args(), nil
 }
 
 func main() {
-	config := args2config()
-	if flag.NFlag() < 1 {
-		fmt.Println("need one or more files as arguments")
-		os.Exit(1)
+	config, filenames, err := args2config(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		os.Exit(2)
+	}
+	if len(filenames) < 1 {
+		// Read from stdin when it is piped rather than a terminal.
+		fi, err := os.Stdin.Stat()
+		if err != nil || fi.Mode()&os.ModeCharDevice != 0 {
+			fmt.Println("need one or more files as arguments")
+			os.Exit(1)
+		}
+		filenames = []string{"-"}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	run(filenames, config, os.Stdin, os.Stdout, signals)
+}
+
+// run tails the given files, "-" standing for stdin, and writes their
+// lines to out until all of the tails end, or a signal is received.
+func run(filenames []string, config tail.Config, stdin io.Reader, out io.Writer, signals <-chan os.Signal) {
+	var tails []*tail.Tail
+	for _, filename := range filenames {
+		t, err := tailFile(filename, config, stdin)
+		if err != nil {
+			fmt.Fprintln(out, err)
+			continue
+		}
+		tails = append(tails, t)
 	}
 
-	done := make(chan bool)
-	for _, filename := range flag.Args() {
-		go tailFile(filename, config, done)
+	done := make(chan bool, len(tails))
+	for _, t := range tails {
+		go printLines(t, out, done)
 	}
 
-	for _, _ = range flag.Args() {
-		<-done
+	for remaining := len(tails); remaining > 0; remaining-- {
+		select {
+		case <-done:
+		case <-signals:
+			// Stop all tails, leaving a moment for the lines already
+			// read to be printed.
+			for _, t := range tails {
+				t.Close()
+			}
+			timeout := time.After(stopTimeout)
+			for ; remaining > 0; remaining-- {
+				select {
+				case <-done:
+				case <-timeout:
+					return
+				}
+			}
+			return
+		}
 	}
 }
 
-func tailFile(filename string, config tail.Config, done chan bool) {
-	defer func() { done <- true }()
-	t, err := tail.TailFile(filename, config)
-	if err != nil {
-		fmt.Println(err)
-		return
+func tailFile(filename string, config tail.Config, stdin io.Reader) (*tail.Tail, error) {
+	if filename == "-" {
+		return tail.TailReader(stdin, config)
 	}
+	return tail.TailFile(filename, config)
+}
+
+func printLines(t *tail.Tail, out io.Writer, done chan bool) {
+	defer func() { done <- true }()
 	for line := range t.Lines {
-		fmt.Println(line.Text)
+		text := line.Text + "\n"
+		if prefix {
+			text = line.Filename + ": " + text
+		}
+		outMu.Lock()
+		io.WriteString(out, text)
+		outMu.Unlock()
 	}
-	err = t.Wait()
+	err := t.Wait()
 	if err != nil {
-		fmt.Println(err)
+		outMu.Lock()
+		fmt.Fprintln(out, err)
+		outMu.Unlock()
 	}
 }
@@ -0,0 +1,159 @@
+// Copyright (c) 2013 ActiveState Software Inc. All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/ActiveState/tail"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestStdin(t *testing.T) {
+	var out bytes.Buffer
+	run([]string{"-"}, tail.Config{Follow: true}, strings.NewReader("hello\nworld\n"), &out, nil)
+	if out.String() != "hello\nworld\n" {
+		t.Fatalf("mismatch; %q (actual) != %q (expected)", out.String(), "hello\nworld\n")
+	}
+}
+
+func TestSignal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "test.txt")
+	if err := ioutil.WriteFile(filename, []byte("hello\nworld\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	signals := make(chan os.Signal, 1)
+	done := make(chan bool)
+	go func() {
+		run([]string{filename}, tail.Config{Follow: true, Location: -1}, nil, &out, signals)
+		done <- true
+	}()
+	<-time.After(100 * time.Millisecond)
+	signals <- syscall.SIGTERM
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the tail to stop")
+	}
+	if out.String() != "hello\nworld\n" {
+		t.Fatalf("mismatch; %q (actual) != %q (expected)", out.String(), "hello\nworld\n")
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var filenames []string
+	for _, name := range []string{"a.txt", "b.txt"} {
+		filename := filepath.Join(dir, name)
+		content := strings.Repeat(name+"\n", 100)
+		if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		filenames = append(filenames, filename)
+	}
+
+	prefix = true
+	defer func() { prefix = false }()
+	var out bytes.Buffer
+	run(filenames, tail.Config{Location: -1}, nil, &out, nil)
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 200 {
+		t.Fatalf("expected 200 lines, got %d", len(lines))
+	}
+	for _, line := range lines {
+		source := strings.SplitN(line, ": ", 2)
+		if len(source) != 2 || filepath.Base(source[0]) != source[1] {
+			t.Fatalf("line not prefixed with its source: %q", line)
+		}
+	}
+}
+
+func TestLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "test.txt")
+	var content strings.Builder
+	for i := 1; i <= 10; i++ {
+		fmt.Fprintf(&content, "line %d\n", i)
+	}
+	if err := ioutil.WriteFile(filename, []byte(content.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, filenames, err := args2config([]string{"-n", "3", filename})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	run(filenames, config, nil, &out, nil)
+	if expected := "line 8\nline 9\nline 10\n"; out.String() != expected {
+		t.Fatalf("mismatch; %q (actual) != %q (expected)", out.String(), expected)
+	}
+
+	for _, n := range []string{"three", "-3"} {
+		if _, _, err := args2config([]string{"-n", n, filename}); err == nil {
+			t.Fatalf("expected an error for -n %s", n)
+		}
+	}
+}
+
+func TestDefaultLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "test.txt")
+	var content strings.Builder
+	for i := 1; i <= 20; i++ {
+		fmt.Fprintf(&content, "line %d\n", i)
+	}
+	if err := ioutil.WriteFile(filename, []byte(content.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The last 10 lines are printed, unless bytes are asked for.
+	var expected strings.Builder
+	for i := 11; i <= 20; i++ {
+		fmt.Fprintf(&expected, "line %d\n", i)
+	}
+	for _, c := range []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{filename}, expected.String()},
+		{[]string{"-c", "8", filename}, "line 20\n"},
+	} {
+		config, filenames, err := args2config(c.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		run(filenames, config, nil, &out, nil)
+		if out.String() != c.expected {
+			t.Fatalf("mismatch for %v; %q (actual) != %q (expected)", c.args, out.String(), c.expected)
+		}
+	}
+}
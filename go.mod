@@ -0,0 +1,8 @@
+module github.com/ActiveState/tail
+
+go 1.23
+
+require (
+	github.com/howeyc/fsnotify v0.9.0
+	gopkg.in/tomb.v1 v1.0.0-20141024135613-dd632973f1e7
+)
@@ -0,0 +1,71 @@
+// Copyright (c) 2013 ActiveState Software Inc. All rights reserved.
+
+package tail
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DecodeJSON consumes the lines of t, which are expected to hold one
+// JSON value each, and delivers them decoded into values of type T.
+// Lines that fail to decode are reported on the error channel, without
+// interrupting the stream. Both channels are closed once t ends, and
+// must be read alongside each other until t is stopped, with Stop,
+// StopWithTimeout or Close, after which values left unread are dropped.
+func DecodeJSON[T any](t *Tail) (<-chan T, <-chan error) {
+	values := make(chan T)
+	errs := make(chan error)
+	go func() {
+		defer close(values)
+		defer close(errs)
+		for line := range t.Lines {
+			var v T
+			data := line.Raw
+			if data == nil {
+				data = []byte(line.Text)
+			}
+			if err := json.Unmarshal(data, &v); err != nil {
+				select {
+				case errs <- fmt.Errorf("Unable to decode line %q: %w", data, err):
+				case <-t.stopped:
+					return
+				}
+				continue
+			}
+			select {
+			case values <- v:
+			case <-t.stopped:
+				return
+			}
+		}
+	}()
+	return values, errs
+}
+
+// dockerJSONLine is a line of a log file written by Docker's json-file
+// logging driver.
+type dockerJSONLine struct {
+	Log    string    `json:"log"`
+	Stream string    `json:"stream"`
+	Time   time.Time `json:"time"`
+}
+
+// ParseDockerJSON is a Config.LineParser for the log files of
+// containers written by Docker's json-file logging driver, with lines
+// such as:
+//
+//	{"log":"hello\n","stream":"stdout","time":"2024-01-02T15:04:05.999999999Z"}
+//
+// The logged line becomes `Line.Text`, stripped of its terminator, and
+// the stream and time it was logged at `Line.Stream` and `Line.Time`.
+func ParseDockerJSON(line []byte) (*Line, error) {
+	var entry dockerJSONLine
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return nil, fmt.Errorf("Unable to decode line %q: %w", line, err)
+	}
+	text := strings.TrimSuffix(strings.TrimSuffix(entry.Log, "\n"), "\r")
+	return &Line{Text: text, Stream: entry.Stream, Time: entry.Time}, nil
+}
@@ -0,0 +1,180 @@
+// Copyright (c) 2013 ActiveState Software Inc. All rights reserved.
+
+package tail
+
+import (
+	"fmt"
+	"github.com/ActiveState/tail/watch"
+	"gopkg.in/tomb.v1"
+	"path/filepath"
+	"sync"
+)
+
+// LatestTail tails the newest of the files matching a pattern, such as
+// those of date-stamped rotation without a stable symlink, switching
+// to newer files as they appear. Files are ordered by name, which for
+// date-stamped names is the order they were created in.
+type LatestTail struct {
+	Lines   chan *Line
+	pattern string
+	config  Config
+	clock   watch.Clock
+
+	mu   sync.Mutex
+	tail *Tail // Of the file being tailed, if any yet
+
+	tomb.Tomb // provides: Done, Kill, Dying, Dead
+}
+
+// TailLatest begins tailing the newest file matching pattern, as per
+// filepath.Match, according to config, and waits for one to appear if
+// none does yet. Once a newer file matches, the current one is read
+// up to its end and left for the newer one, which is read from its
+// beginning; Location and the like only apply to the first file.
+// Files are always followed, and as for a MultiTail, events, batches
+// and routes are not supported. Lines is closed once stopped.
+func TailLatest(pattern string, config Config) (*LatestTail, error) {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("Unable to tail %s: %w", pattern, err)
+	}
+	config.Follow = true
+	config.ReportEvents = false
+	config.Batch = 0
+	config.Routes = nil
+	config.normalize()
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("Unable to tail %s: %w", pattern, err)
+	}
+
+	lt := &LatestTail{
+		Lines:   make(chan *Line),
+		pattern: pattern,
+		config:  config,
+		clock:   watch.RealClock}
+	if config.Clock != nil {
+		lt.clock = config.Clock
+	}
+	go lt.run()
+	return lt, nil
+}
+
+// Filename returns the name of the file being tailed, or "" if none
+// matched yet.
+func (lt *LatestTail) Filename() string {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	if lt.tail == nil {
+		return ""
+	}
+	return lt.tail.Filename
+}
+
+// Stop stops tailing and waits for Lines to be closed. It returns the
+// error tailing ended with, if any.
+func (lt *LatestTail) Stop() error {
+	lt.Kill(nil)
+	return lt.Wait()
+}
+
+// latest returns the name of the newest file matching the pattern,
+// or "" if there is none.
+func (lt *LatestTail) latest() (string, error) {
+	matches, err := filepath.Glob(lt.pattern)
+	if err != nil {
+		return "", err
+	}
+	var latest string
+	for _, match := range matches {
+		if match > latest {
+			latest = match
+		}
+	}
+	return latest, nil
+}
+
+// next begins tailing filename in place of the current tail, if any,
+// which has ended.
+func (lt *LatestTail) next(current *Tail, filename string) (*Tail, error) {
+	config := lt.config
+	if current != nil {
+		config.Location, config.NLines, config.StartLine = LocationStart, 0, 0
+		config.Resume = nil
+	}
+	t, err := TailFile(filename, config)
+	if err != nil {
+		return nil, err
+	}
+	lt.mu.Lock()
+	lt.tail = t
+	lt.mu.Unlock()
+	return t, nil
+}
+
+func (lt *LatestTail) run() {
+	defer lt.Done()
+	defer close(lt.Lines)
+
+	var current *Tail
+	defer func() {
+		if current != nil {
+			current.Stop()
+		}
+	}()
+
+	var lines <-chan *Line
+	var errs <-chan error
+	poll := lt.clock.After(0)
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				// Ended once read up to its end for a newer file,
+				// or on its own, such as once deleted while followed
+				// by descriptor, in which case a newer one is waited
+				// for.
+				if err := current.Wait(); err != nil {
+					lt.Kill(err)
+					return
+				}
+				lines, errs = nil, nil
+				poll = lt.clock.After(0)
+				continue
+			}
+			select {
+			case lt.Lines <- line:
+			case <-lt.Dying():
+				return
+			}
+		case _, ok := <-errs:
+			// Errors of the LineParser are dropped.
+			if !ok {
+				errs = nil
+			}
+		case <-poll:
+			poll = lt.clock.After(watch.POLL_DURATION)
+			latest, err := lt.latest()
+			if err != nil {
+				lt.Kill(err)
+				return
+			}
+			if latest == "" || current != nil && latest <= current.Filename {
+				continue // Nothing newer.
+			}
+			if lines != nil {
+				// The current file is read up to its end, and the
+				// lines it holds back delivered, before it ends for
+				// the newer one.
+				current.stopAtEOF()
+				continue
+			}
+			current, err = lt.next(current, latest)
+			if err != nil {
+				lt.Kill(err)
+				return
+			}
+			lines, errs = current.Lines, current.Errors
+		case <-lt.Dying():
+			return
+		}
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright (c) 2013 ActiveState Software Inc. All rights reserved.
+
+package tail
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// MultiTail tails a set of files with a shared configuration, merging
+// their lines on a single channel. Files can be added and removed
+// while tailing; `Line.Filename` tells which file each line is from.
+type MultiTail struct {
+	Lines  chan *Line
+	config Config
+
+	mu      sync.Mutex
+	tails   map[string]*Tail
+	active  map[*Tail]int64 // When each tail last delivered a line, per clock
+	clock   int64           // Logical clock ordering the activity of tails
+	stopped bool
+	wg      sync.WaitGroup          // Goroutines forwarding lines to Lines
+	done    map[*Tail]chan struct{} // Closed as the goroutine of each tail returns
+}
+
+// NewMultiTail begins tailing the given files according to config.
+// Unlike for a single Tail, `MultiTail.Lines` remains open when the
+// tails end, as files may still be added, until Stop is called.
+func NewMultiTail(config Config, filenames ...string) (*MultiTail, error) {
+	// Only lines are merged, so events, batches and routes are not
+	// supported, and errors of the LineParser are dropped.
+	config.ReportEvents = false
+	config.Batch = 0
+	config.Routes = nil
+
+	mt := &MultiTail{
+		Lines:  make(chan *Line),
+		config: config,
+		tails:  make(map[string]*Tail),
+		active: make(map[*Tail]int64),
+		done:   make(map[*Tail]chan struct{})}
+	for _, filename := range filenames {
+		if err := mt.Add(filename); err != nil {
+			mt.Stop()
+			return nil, err
+		}
+	}
+	return mt, nil
+}
+
+// Add begins tailing another file. It is safe to call concurrently.
+func (mt *MultiTail) Add(filename string) error {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	if mt.stopped {
+		return fmt.Errorf("Cannot add %s to a stopped MultiTail", filename)
+	}
+	if _, ok := mt.tails[filename]; ok {
+		return fmt.Errorf("%s is already being tailed", filename)
+	}
+	t, err := TailFile(filename, mt.config)
+	if err != nil {
+		return err
+	}
+	mt.tails[filename] = t
+	mt.touch(t)
+	done := make(chan struct{})
+	mt.done[t] = done
+	mt.wg.Add(1)
+	go mt.forward(filename, t, done)
+	return nil
+}
+
+// Remove stops tailing a file; none of its lines are delivered once
+// Remove returns. It is safe to call concurrently.
+func (mt *MultiTail) Remove(filename string) error {
+	mt.mu.Lock()
+	t, ok := mt.tails[filename]
+	done := mt.done[t]
+	delete(mt.tails, filename)
+	mt.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%s is not being tailed", filename)
+	}
+	err := t.Stop()
+	<-done
+	return err
+}
+
+// Files returns the sorted names of the files being tailed. Files
+// whose tail ended, such as on reaching EOF without Follow, are left
+// out.
+func (mt *MultiTail) Files() []string {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	filenames := make([]string, 0, len(mt.tails))
+	for filename := range mt.tails {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	return filenames
+}
+
+// Stop stops tailing all files and closes Lines. It returns the first
+// error any of the tails died with.
+func (mt *MultiTail) Stop() error {
+	mt.mu.Lock()
+	if mt.stopped {
+		mt.mu.Unlock()
+		return nil
+	}
+	mt.stopped = true
+	tails := mt.tails
+	mt.tails = make(map[string]*Tail)
+	mt.mu.Unlock()
+
+	var firstErr error
+	for _, t := range tails {
+		if err := t.Stop(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	mt.wg.Wait()
+	close(mt.Lines)
+	return firstErr
+}
+
+// forward delivers the lines of a tail on Lines, until the tail ends,
+// and closes done.
+func (mt *MultiTail) forward(filename string, t *Tail, done chan struct{}) {
+	defer mt.wg.Done()
+	defer close(done)
+	defer func() {
+		mt.mu.Lock()
+		if mt.tails[filename] == t {
+			delete(mt.tails, filename)
+		}
+		delete(mt.active, t)
+		delete(mt.done, t)
+		mt.mu.Unlock()
+	}()
+	errs := t.Errors
+	for {
+		select {
+		case line, ok := <-t.Lines:
+			if !ok {
+				return
+			}
+			mt.mu.Lock()
+			mt.touch(t)
+			mt.mu.Unlock()
+			select {
+			case <-t.Dying():
+				return // Removed, or stopped, while the line was read.
+			default:
+			}
+			select {
+			case mt.Lines <- line:
+			case <-t.Dying():
+				return
+			}
+		case _, ok := <-errs:
+			if !ok {
+				errs = nil
+			}
+		}
+	}
+}
+
+// touch records t as the most recently active tail, and has the files
+// of the least recently active ones closed for at most MaxOpenFiles to
+// remain open. It must be called with mu held.
+func (mt *MultiTail) touch(t *Tail) {
+	if mt.active[t] != mt.clock || mt.clock == 0 {
+		mt.clock++
+		mt.active[t] = mt.clock
+	}
+	if mt.config.MaxOpenFiles <= 0 {
+		return
+	}
+
+	// The files are counted even if t was already the most recently
+	// active, as its file may have been closed and opened again since.
+	var open []*Tail
+	for other := range mt.active {
+		if other.holdsFile() {
+			open = append(open, other)
+		}
+	}
+	sort.Slice(open, func(i, j int) bool {
+		return mt.active[open[i]] < mt.active[open[j]]
+	})
+	for len(open) > mt.config.MaxOpenFiles {
+		open[0].releaseFile()
+		open = open[1:]
+	}
+}
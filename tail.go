@@ -4,45 +4,681 @@ package tail
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/ActiveState/tail/watch"
+	"gopkg.in/tomb.v1"
 	"io"
-	"launchpad.net/tomb"
+	"io/fs"
+	"iter"
 	"log"
 	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 var (
-	ErrStop = fmt.Errorf("tail should now stop")
+	ErrStop       = fmt.Errorf("tail should now stop")
+	ErrNotStarted = fmt.Errorf("tail has not started reading yet")
+
+	// ErrMaxBytesReached is what the tail dies with once MaxBytes
+	// have been read.
+	ErrMaxBytesReached = fmt.Errorf("tail has read the maximum number of bytes")
+
+	// ErrNotRegularFile is returned when the path to tail is neither a
+	// regular file nor a named pipe, such as a directory.
+	ErrNotRegularFile = fmt.Errorf("not a regular file")
+
+	// ErrPathIsDirectory is returned when the path to tail is a
+	// directory; it wraps ErrNotRegularFile. With ReOpen, the path is
+	// waited for to be a file again instead.
+	ErrPathIsDirectory = fmt.Errorf("%w: is a directory", ErrNotRegularFile)
+
+	// ErrNoFile is returned by FileInfo while no file is open.
+	ErrNoFile = fmt.Errorf("tail has no file open")
+
+	// ErrReOpenRequiresFollow is returned, wrapped, when ReOpen is
+	// set without Follow.
+	ErrReOpenRequiresFollow = fmt.Errorf("cannot set ReOpen without Follow")
+
+	// ErrInvalidMaxLineSize is returned, wrapped, when MaxLineSize is
+	// negative.
+	ErrInvalidMaxLineSize = fmt.Errorf("invalid MaxLineSize")
+
+	// ErrNotSeekable is returned when a file opened from Config.FS
+	// does not support seeking.
+	ErrNotSeekable = fmt.Errorf("file does not support seeking")
+
+	// ErrBinaryFile is returned, wrapped, when opening a file that
+	// looks binary with BinaryRefuse.
+	ErrBinaryFile = fmt.Errorf("binary file")
+
+	// ErrStopTimeout is returned by StopWithTimeout when the tail did
+	// not end in time.
+	ErrStopTimeout = fmt.Errorf("timeout waiting for tail to stop")
+
+	// ErrReadTimeout is the error of a read abandoned after
+	// Config.ReadTimeout; reading is then retried.
+	ErrReadTimeout = fmt.Errorf("read timed out")
+
+	// ErrWaitTimeout is returned when the file did not come into
+	// existence within Config.WaitTimeout.
+	ErrWaitTimeout = watch.ErrWaitTimeout
+)
+
+// TailError records an error tailing a file, along with the operation
+// that failed, such as "open", "seek" or "read". The errors a tail dies
+// with when accessing the file are TailErrors, so that their cause,
+// such as os.ErrPermission, can be checked with errors.Is.
+type TailError struct {
+	Filename string
+	Op       string
+	Err      error
+}
+
+func (e *TailError) Error() string {
+	err := e.Err
+	// Spare repeating the operation and file a PathError names.
+	if pathErr, ok := err.(*os.PathError); ok && pathErr.Path == e.Filename {
+		err = pathErr.Err
+	}
+	return e.Op + " " + e.Filename + ": " + err.Error()
+}
+
+func (e *TailError) Unwrap() error {
+	return e.Err
+}
+
+// truncationCheckSize is the number of bytes preceding the read
+// offset that are compared to detect a truncated and rewritten file.
+const truncationCheckSize = 16
+
+// defaultBatchTimeout is how long a batch is held back at most when
+// Config.BatchTimeout is not set.
+const defaultBatchTimeout = 100 * time.Millisecond
+
+// ansiEscape matches ANSI CSI escape sequences, such as those setting
+// terminal colors.
+var ansiEscape = regexp.MustCompile("\x1b\\[[0-?]*[ -/]*[@-~]")
+
+// readRetryDelay is how long to wait before reading again after a
+// transient read error.
+const readRetryDelay = 100 * time.Millisecond
+
+// emptyWakeupBackoff is how long to wait before reading again after a
+// change notification that yielded no data, doubling for each further
+// one in a row up to maxEmptyWakeupBackoff. Some file systems notify
+// of changes repeatedly without any data to read.
+const (
+	emptyWakeupBackoff    = time.Millisecond
+	maxEmptyWakeupBackoff = 50 * time.Millisecond
 )
 
+// DefaultHardMaxLineBytes is the size beyond which lines are split
+// when Config.HardMaxLineBytes is not set.
+const DefaultHardMaxLineBytes = 64 << 20
+
+// rawBlockSize is the size of the blocks of memory lines are copied
+// to per Config.Raw.
+const rawBlockSize = 64 << 10
+
+// repeatTimeout is how long a line repeated per CollapseRepeats is
+// held back at most, for a long run of repeats to be reported still.
+const repeatTimeout = time.Second
+
 type Line struct {
-	Text string
+	Text    string // Line content; its terminator, per LineEnding, is stripped unless KeepLineEnding is set
+	Bytes   []byte // Record content, when RecordSize is set
+	Raw     []byte // Line content in place of Text, when Raw is set; see Config.Raw
+	Time    time.Time
+	Dropped int64 // If positive, this is a marker for bytes skipped per MaxLag
+
+	Filename string // Name of the file the line was read from
+	Num      int64  // Sequence number of the line since the tail started, from 0
+	Stream   string // Stream the line was logged to, such as "stdout", if set by LineParser
+
+	// Offset is the offset in the file past the line, from which to
+	// resume once the line is processed; see Commit. Sub-lines of a
+	// line split per MaxLineSize share the offset past the whole line.
+	Offset int64
+
+	// Repeat is the number of consecutive identical lines the line
+	// stands for, with CollapseRepeats; the Offset is that past the
+	// last of them.
+	Repeat int
+
+	// Delimiter is the byte, of Config.Delimiters, that ended the
+	// line; it is 0 without Delimiters, and for a line read before
+	// its delimiter was written.
+	Delimiter byte
+}
+
+// ResumeInfo records where to resume tailing a file, as returned by
+// `Tail.ResumeInfo` and set as `Config.Resume`.
+type ResumeInfo struct {
+	Offset int64 // Offset in the file to resume from
+
+	// Fingerprint is a hash of the beginning of the file, up to the
+	// offset, to tell whether the file was replaced. If empty, only
+	// the size of the file is checked.
+	Fingerprint []byte
+}
+
+// fingerprintSize is the number of bytes at the beginning of a file
+// that `ResumeInfo.Fingerprint` is a hash of, when beyond the offset.
+const fingerprintSize = 1024
+
+// EventType identifies what happened to the tailed file.
+type EventType int
+
+const (
+	EventTruncated   EventType = iota // File was truncated
+	EventRotated                      // File was moved/renamed
+	EventFileDeleted                  // File was deleted
+	EventReopened                     // File was reopened
+	EventHeartbeat                    // Still tailing, per HeartbeatInterval
+)
+
+// Event reports a change to the tailed file, as delivered on
+// `Tail.Events` when ReportEvents is set.
+type Event struct {
+	Type EventType
 	Time time.Time
+
+	// Lost, for EventRotated and EventFileDeleted, is an estimate of
+	// the bytes of the file that were left unread. The rest of the
+	// file is read before it is let go, so this is only the case when
+	// reading it fails, or its descriptor was closed per MaxOpenFiles
+	// or ReleaseFDWhenIdle.
+	Lost int64
 }
 
+// FollowMode selects what is followed once the tailed file is renamed.
+type FollowMode int
+
+const (
+	// FollowDefault derives the mode from Follow and ReOpen: ReOpen
+	// means FollowByName, Follow alone FollowByDescriptor.
+	FollowDefault FollowMode = iota
+
+	// FollowByDescriptor keeps reading the opened file after it is
+	// renamed, as `tail -f` does. Tailing stops when the file is
+	// deleted.
+	FollowByDescriptor
+
+	// FollowByName reopens the path once the file is renamed or
+	// deleted, as `tail -F` does; the new file is read from its
+	// beginning.
+	FollowByName
+)
+
+// BinaryBehavior selects how files that look binary are handled.
+type BinaryBehavior int
+
+const (
+	// BinaryAllow reads binary files as if they were text.
+	BinaryAllow BinaryBehavior = iota
+
+	// BinaryRefuse fails opening binary files with ErrBinaryFile.
+	BinaryRefuse
+
+	// BinaryHexdump emits binary files as lines of a hex dump, of 16
+	// bytes each, in the format of `hexdump -C`.
+	BinaryHexdump
+)
+
+// LineEnding selects the terminator lines are delimited by.
+type LineEnding int
+
+const (
+	// LineEndingLF ends lines with "\n", stripped of a preceding
+	// "\r" as well.
+	LineEndingLF LineEnding = iota
+
+	// LineEndingCRLF ends lines with "\r\n" only; a lone "\n" is
+	// part of the line.
+	LineEndingCRLF
+
+	// LineEndingCR ends lines with "\r", as files of classic Mac OS.
+	LineEndingCR
+
+	// LineEndingAuto selects LineEndingCR for files whose first
+	// terminator is a "\r" not followed by "\n", as found in their
+	// first 4096 bytes when they are opened, and LineEndingLF
+	// otherwise, including for pipes and readers.
+	LineEndingAuto
+)
+
+// lineEndingSniffSize is the number of bytes at the beginning of a
+// file looked at for LineEndingAuto.
+const lineEndingSniffSize = 4096
+
+// binarySniffSize is the number of bytes at the beginning of a file
+// looked at to tell whether it is binary.
+const binarySniffSize = 512
+
+// hexdumpWidth is the number of bytes per line of a hex dump.
+const hexdumpWidth = 16
+
+// Locations at either end of the file, for Config.Location.
+const (
+	LocationEnd   = 0  // Only read data appended once tailing begins
+	LocationStart = -1 // Read the file from its beginning
+)
+
 // Config is used to specify how a file must be tailed.
+//
+// Location selects where tailing begins on first open of the file:
+//
+//	 0  at the end of the file, so that only new data is read
+//	 N  N bytes before the end of the file (tail -c N)
+//	-N  N-1 bytes after the beginning of the file; -1 is the beginning
+//
+// LocationEnd, the default, and LocationStart name 0 and -1. When
+// following, the end is that of the file when TailFile returns, so
+// that what is written from then on is read; all of a file yet to be
+// created is read, as for files opened anew per ReOpen.
+//
+// The resulting offset is clamped to the bounds of the file, so that
+// a Location beyond either end starts at that end.
 type Config struct {
-	Location    int  // Tail from last N lines (tail -n)
+	Location    int  // Where to start tailing from (see above)
 	Follow      bool // Continue looking for new lines (tail -f)
 	ReOpen      bool // Reopen recreated files (tail -F)
 	MustExist   bool // Fail early if the file does not exist
 	Poll        bool // Poll for file changes instead of using inotify
 	MaxLineSize int  // If non-zero, split longer lines into multiple lines
+	StripANSI   bool // Remove ANSI escape sequences, such as colors, from lines
+	NLines      int  // If positive, tail from the last N lines instead of Location
+	RecordSize  int  // If positive, read fixed-size records into Line.Bytes instead of lines
+
+	// TrimSpace removes leading and trailing white space from lines,
+	// so that lines of white space only are empty. SkipEmptyLines
+	// drops empty lines, after any trimming, instead of emitting them.
+	TrimSpace      bool
+	SkipEmptyLines bool
+
+	// Raw delivers the content of lines as `Line.Raw` instead of
+	// `Line.Text`, saving its conversion to a string. The tail never
+	// reuses nor writes to Raw, but lines share blocks of memory
+	// allocated for many at a time: a Raw retained for long should be
+	// copied, not to keep the whole block alive. It does not apply
+	// with RecordSize or LineParser.
+	Raw bool
+
+	// HardMaxLineBytes bounds the bytes held in memory for a single
+	// line, such as a malicious one with no terminator in sight: past
+	// this many bytes, the line read so far is emitted on its own, and
+	// the rest of it as the next lines. Unlike MaxLineSize, it does
+	// not depend on the line being read whole first. Zero means
+	// DefaultHardMaxLineBytes, and a negative value no limit.
+	HardMaxLineBytes int
+
+	// MustExistTimeout, if positive, lets MustExist wait for up to
+	// this long for the file to be created before failing.
+	MustExistTimeout time.Duration
+
+	// WaitTimeout, if positive, bounds each wait for the file to be
+	// created, be it before tailing it, or once it is gone with
+	// ReOpen, such as on storage that is slow to make files visible.
+	// The tail then dies with an error wrapping ErrWaitTimeout.
+	WaitTimeout time.Duration
+
+	// ReaderBufferSize, if positive, is the size of the buffer the
+	// file is read through, in place of bufio's default of 4096 bytes.
+	// A larger buffer takes fewer reads to go through a backlog.
+	ReaderBufferSize int
+
+	// Preload has files of up to 1 MiB, when opened, read whole in a
+	// single read, then only what was appended to them on each change,
+	// in place of reads of the size of the buffer, which saves system
+	// calls for small files changing often. A truncated file is read
+	// whole again. It does not apply to pipes or readers.
+	Preload bool
+
+	// KeepLineEnding retains the terminator of each line, such as
+	// "\n" or "\r\n", in `Line.Text`. A line read before its
+	// terminator was written has none.
+	KeepLineEnding bool
+
+	// LineEnding selects the terminator of lines, by default "\n".
+	LineEnding LineEnding
+
+	// Delimiters, if set, has lines end at any of these bytes, in
+	// place of LineEnding, such as "\n\x1e" for lines ended by either
+	// a newline or a record separator; `Line.Delimiter` tells which.
+	// Seeking by lines, per NLines, StartTime, StartPercent, StartLine
+	// or MaxLag, is not supported along with it.
+	Delimiters []byte
+
+	// FollowMode, if set, implies Follow, and ReOpen for
+	// FollowByName.
+	FollowMode FollowMode
+
+	// FollowSymlinks, when following, reopens the path once it is a
+	// symbolic link repointed to another file, which is then read
+	// from its beginning.
+	FollowSymlinks bool
+
+	// MaxBytes, if positive, caps the total number of bytes read,
+	// counted across reopens of the file. The line during which the
+	// cap is reached is still emitted, then the tail stops with
+	// ErrMaxBytesReached.
+	MaxBytes int64
+
+	// TimeParser, if set, extracts the time a line was logged at from
+	// its text, to be used as `Line.Time` in place of the time it was
+	// read. Lines it fails to parse keep the read time.
+	TimeParser func(text string) (time.Time, bool)
+
+	// StartTime, if set along with TimeParser, starts tailing from
+	// the first line logged at or after it, in place of Location. The
+	// file is binary searched when its timestamps are in order.
+	StartTime time.Time
+
+	// StartLine, if positive, starts tailing from that line of the
+	// file, counting from 1, in place of Location, such as 1000 to
+	// skip the first 999 lines. The file is scanned from its beginning
+	// to count them. Files with fewer lines are tailed from their end.
+	// It does not apply with RecordSize.
+	StartLine int
+
+	// Resume, if set, as saved from `Tail.ResumeInfo`, resumes tailing
+	// from its offset, in place of Location, provided the file is
+	// still the one it was saved for: the file is read from its
+	// beginning if it is now shorter than the offset, having been
+	// truncated or rotated since, or if the fingerprint no longer
+	// matches, the file being another one.
+	Resume *ResumeInfo
+
+	// StartPercent, if positive, starts tailing from the first line
+	// beginning at or after that percentage of the file size, in
+	// place of Location, such as 90 to skip most of a large file. It
+	// ranges up to 100, the end of the file, and does not apply to
+	// pipes or readers.
+	StartPercent float64
+
+	// Batch, if greater than 1, groups lines into slices of up to
+	// Batch lines delivered on `Tail.Batches` instead of `Tail.Lines`.
+	// A batch is sent once full, or BatchTimeout after its first line
+	// was read (100ms if unset), so that slow logs are not held back.
+	Batch        int
+	BatchTimeout time.Duration
+
+	// MaxLag, if positive, is the number of unread bytes beyond which
+	// the tail gives up on the backlog and skips ahead to the lines
+	// within the last MaxLag bytes of the file. A Line with only
+	// Dropped set reports how many bytes were skipped.
+	MaxLag int64
+
+	// RateLimit, if positive, is the maximum number of lines emitted
+	// per second. Reading from the file is paced accordingly.
+	RateLimit float64
+
+	// WatcherFactory, if set, creates the watcher used to monitor the
+	// file, overriding the choice between inotify and polling.
+	WatcherFactory func(filename string) watch.FileWatcher
+
+	// Clock, if set, replaces the system time as the time source for
+	// polling, the timers of the tail and rate limiting, and for the
+	// Time of lines and events, which lets tests control the passing
+	// of time.
+	Clock watch.Clock
+
+	// RetryableError, if set, decides which errors returned when
+	// reading the file are transient, in which case reading is retried
+	// after a short delay instead of ending the tail. By default
+	// EINTR, EAGAIN and ESTALE are retried.
+	RetryableError func(err error) bool
+
+	// RetryOnPermissionDenied has the file closed once permission to
+	// read it is denied, such as by a transient chmod, and opened
+	// again at the poll interval until permission is restored, to read
+	// on from where reading failed; otherwise, the tail dies. This
+	// applies as well to files being reopened, and not to pipes.
+	RetryOnPermissionDenied bool
+
+	// ReportEvents enables delivery of truncation, rotation and
+	// reopen events on `Tail.Events`, which must then be read
+	// alongside `Tail.Lines`.
+	ReportEvents bool
+
+	// HeartbeatInterval, if positive, has EventHeartbeat delivered
+	// on `Tail.Events` at this interval while no lines are read, for
+	// consumers to know that the tail is alive when the file is idle.
+	// Heartbeats pause while lines are read. It requires ReportEvents.
+	HeartbeatInterval time.Duration
+
+	// LineParser, if set, makes the Line emitted for each line out of
+	// its content, stripped of its terminator, such as to unwrap the
+	// envelope of container logs (see ParseDockerJSON). A zero
+	// `Line.Time` is set to the time the line was read; MaxLineSize,
+	// TimeParser and KeepLineEnding do not apply. The content is only
+	// valid during the call. Lines it fails to parse are reported on
+	// `Tail.Errors`, which must then be read alongside `Tail.Lines`,
+	// and skipped.
+	LineParser func(line []byte) (*Line, error)
+
+	// PollHashSize, if positive, has the polling watcher hash this
+	// many bytes at the end of the file on each poll, to notice
+	// changes that leave its size and modification time as they were,
+	// such as the file being rewritten in place within the second on
+	// file systems with coarse modification times.
+	PollHashSize int
+
+	// PollMinInterval and PollMaxInterval, if both set, have the
+	// polling watcher adapt its poll interval between them: it is
+	// halved on each poll finding changes, for little latency while
+	// the file is busy, and doubled on each finding none, for little
+	// CPU while it is idle. SetPollInterval sets where it starts.
+	PollMinInterval time.Duration
+	PollMaxInterval time.Duration
+
+	// InotifyCheckInterval is how often the inotify watcher checks
+	// for changes no event reached it for, by default every second:
+	// that the path still leads to the file watched, for the file to
+	// be reopened per ReOpen once replaced without any event, as
+	// happens on the copy-up of a file of overlayfs in containers, and
+	// that its size is as last seen, as events are dropped once the
+	// inotify queue overflows. The path is also checked on each
+	// modification of the file, and polling watchers check on each
+	// poll.
+	InotifyCheckInterval time.Duration
+
+	// FS, if set, is the file system in which the file is looked up,
+	// in place of that of the OS, such as for tailing files of an
+	// embedded or virtual file system. Its files must implement
+	// io.Seeker and io.ReaderAt. As inotify only applies to the OS,
+	// Poll or WatcherFactory must be set as well. The polling watcher
+	// tells files apart by what `FileInfo.Sys` returns for them, for
+	// rotations to be noticed. FollowSymlinks is not supported.
+	FS fs.FS
+
+	// Routes, if set, dispatches lines to the channels of
+	// `Tail.Routed`, one per route listed, such as to separate the
+	// lines of the subsystems of a multiplexed log. Each line goes to
+	// the route RouteFunc returns for it, or by default to the first
+	// route its text starts with, and to `Tail.Lines` should that not
+	// be one of Routes. All of these channels must be read alongside
+	// each other. Routes cannot be combined with Batch.
+	Routes    []string
+	RouteFunc func(line []byte) string
+
+	// BinaryBehavior selects how a file is handled when it looks
+	// binary, as told from its first 512 bytes when it is opened:
+	// holding a NUL byte, or mostly control characters. A file that
+	// is empty when opened is taken for text. It does not apply with
+	// RecordSize, to pipes or to readers.
+	BinaryBehavior BinaryBehavior
+
+	// HealthCheckInterval, if positive, is how long the tail waits
+	// for the watcher to report changes before checking the file for
+	// unread data itself, which is then read. This guards against
+	// notifications getting lost.
+	HealthCheckInterval time.Duration
+
+	// MaxOpenFiles, if positive, is how many of its files MultiTail
+	// keeps open at most. Beyond that, the files of the tails least
+	// recently active are closed while they wait for changes, and
+	// opened again by name once their watcher reports one, to be read
+	// on from where they were left. This requires ReOpen, following by
+	// name. It does not apply to a single Tail.
+	MaxOpenFiles int
+
+	// ReleaseFDWhenIdle, if positive, has the file closed once no data
+	// was read from it for this long, and opened again by name once
+	// its watcher reports a change, to be read on from where it was
+	// left, such as for many tails of files rarely written to not to
+	// hold as many descriptors. Like MaxOpenFiles, it requires ReOpen.
+	ReleaseFDWhenIdle time.Duration
+
+	// CollapseRepeats emits consecutive lines of identical content as
+	// one, with `Line.Repeat` set to their number. A line is held back
+	// until a different one is read, or for a second at most, so that
+	// a long run of repeats is reported in parts.
+	CollapseRepeats bool
+
+	// SkipHeaderLines, if positive, is the number of lines at the
+	// beginning of the file, such as the header of a CSV file, that
+	// are not emitted when it is read from there. They are counted
+	// before being split per MaxLineSize. The files opened anew once
+	// rotated are only skipped the header of with SkipHeaderOnReopen.
+	// It does not apply with RecordSize.
+	SkipHeaderLines    int
+	SkipHeaderOnReopen bool
+
+	// ReadTimeout, if positive, is how long a read of the file may
+	// take before it is abandoned, and retried after a short delay,
+	// such as when the server of a network file system stalls. The
+	// tail thus remains responsive to Stop. A read that was abandoned
+	// is waited for by the next one, whose data it provides. It does
+	// not apply to pipes or readers.
+	ReadTimeout time.Duration
+
+	// OnLine, if set, is called from the read loop with each line
+	// right before it is sent, such as to measure how long lines take
+	// to be read after being written. It must return quickly, as
+	// reading is held up meanwhile.
+	OnLine func(line *Line)
+
+	// ReplayBuffer, if positive, is the number of the most recent
+	// lines emitted retained for `Tail.Recent`, such as to prime a
+	// new subscriber of a log-streaming server before it follows the
+	// lines to come.
+	ReplayBuffer int
+
+	// OnReopen, if set, is called from the read loop once the file is
+	// opened anew, such as after a rotation, with the FileInfo of the
+	// file previously tailed, nil on first open, and that of the new
+	// one. It must return quickly, as reading is held up meanwhile.
+	OnReopen func(oldInfo, newInfo os.FileInfo)
+}
+
+// seekableFile is the file being tailed: an *os.File, or a file of
+// Config.FS.
+type seekableFile interface {
+	fs.File
+	io.Seeker
+	io.ReaderAt
 }
 
 type Tail struct {
 	Filename string
 	Lines    chan *Line
+	Events   chan Event   // Only set if Config.ReportEvents is true
+	Batches  chan []*Line // Only set if Config.Batch > 1, replacing Lines
+	Errors   chan error   // Only set if Config.LineParser is set
+
+	// Config the tail was started with. Its fields must not be
+	// assigned while the tail is running; SetPollInterval,
+	// SetRateLimit and SetMaxLineSize change those that can be.
 	Config
 
-	file    *os.File
+	// Channels of the lines dispatched per Config.Routes, by route.
+	// Lines of no route are sent on Lines.
+	Routed map[string]chan *Line
+
+	file    seekableFile // Only changed by the read loop, while holding mu
+	input   io.Reader    // Read in place of file, for TailReader
 	reader  *bufio.Reader
+	src     *offsetReader // Source of reader, tracking the file offset
 	watcher watch.FileWatcher
 	changes *watch.FileChanges
+	clock   watch.Clock
+	resets  chan bool // Pending Reset requests
+	resyncs chan bool // Pending Resync requests
+	release chan bool // Pending requests to close the file while idle
+	finish  chan bool // Pending request to end at EOF, per stopAtEOF
+
+	// Set to end at EOF, as if not following the file, per stopAtEOF.
+	finishing atomic.Bool
+
+	// Size of the file once watched by TailFile, or 0 if it was yet
+	// to be created, which is tailed from rather than its size at the
+	// initial seek; -1 if unknown.
+	startSize int64
 
-	tomb.Tomb // provides: Done, Kill, Dying
+	// Read offset and the bytes preceding it when EOF was last
+	// reached; used to detect truncations missed by the watcher.
+	eofOffset int64
+	eofBytes  []byte
+
+	opened os.FileInfo // Of the file last opened, for OnReopen
+
+	// Read offset when the file was last reported modified, and the
+	// number of reports in a row since which no data was read.
+	wakeupOffset int64
+	emptyWakeups int
+
+	headerLeft int        // Header lines left to skip, per SkipHeaderLines
+	delims     [256]bool  // Bytes of Delimiters
+	ending     LineEnding // LineEnding of the file, once sniffed for LineEndingAuto
+
+	renamed   bool  // File was renamed while following by descriptor
+	fifo      bool  // File is a named pipe
+	hexdump   bool  // File is binary, and read as a hex dump
+	bytesRead int64 // Total bytes read, for MaxBytes
+
+	partial  []byte    // Incomplete record read so far
+	rawBlock []byte    // Memory the Raw of the next lines is copied to
+	nextEmit time.Time // Earliest time the next line may be emitted
+	numLines int64     // Number of lines emitted, across reopens
+
+	batch      []*Line          // Lines pending to be sent on Batches
+	batchTimer <-chan time.Time // Fires when batch is due
+
+	repeated    *Line            // Line pending per CollapseRepeats
+	repeatTimer <-chan time.Time // Fires when repeated is due
+
+	heartbeat <-chan time.Time // Fires when a heartbeat is due while idle
+	idleTimer <-chan time.Time // Fires when the file is to be released while idle
+
+	started  chan struct{} // Closed once seeked to the starting location
+	stopped  chan struct{} // Closed once stopped, per stop
+	stopOnce sync.Once
+	mu       sync.Mutex // Protects the fields below
+	position int64      // Offset up to which the file has been read
+	caughtUp bool       // All data written so far has been read
+	lost     int64      // Bytes left unread in files moved or deleted
+	commit   int64      // Highest offset committed in the current file
+	recent   []*Line    // Ring of the last ReplayBuffer lines emitted
+	oldest   int        // Index in recent of the oldest line, once full
+
+	// Set while running by SetPollInterval; zero stands for
+	// watch.POLL_DURATION. RateLimit and MaxLineSize are also only
+	// accessed while holding mu, as their setters change them.
+	pollInterval time.Duration
+
+	tomb.Tomb // provides: Done, Kill, Dying, Dead
 }
 
 // TailFile begins tailing the file. Output stream is made available
@@ -50,31 +686,50 @@ type Tail struct {
 // invoke the `Wait` or `Err` method after finishing reading from the
 // `Lines` channel.
 func TailFile(filename string, config Config) (*Tail, error) {
-	if !(config.Location == 0 || config.Location == -1) {
-		panic("only 0/-1 values are supported for Location.")
-	}
-
-	if config.ReOpen && !config.Follow {
-		panic("cannot set ReOpen without Follow.")
+	config.normalize()
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("Unable to tail %s: %w", filename, err)
 	}
 
-	t := &Tail{
-		Filename: filename,
-		Lines:    make(chan *Line),
-		Config:   config}
+	t := newTail(filename, config)
 
-	if t.Poll {
-		t.watcher = watch.NewPollingFileWatcher(filename)
-	} else {
-		t.watcher = watch.NewInotifyFileWatcher(filename)
+	switch {
+	case t.WatcherFactory != nil:
+		t.watcher = t.WatcherFactory(filename)
+	case t.Poll:
+		t.watcher = t.pollingWatcher()
+	default:
+		fw, err := newInotifyWatcher(filename)
+		if err != nil {
+			return nil, err
+		}
+		if fw, ok := fw.(*watch.InotifyFileWatcher); ok {
+			fw.CheckInterval = t.InotifyCheckInterval
+		}
+		t.watcher = fw
 	}
 
 	if t.MustExist {
-		var err error
-		t.file, err = os.Open(t.Filename)
+		err := t.open()
+		if os.IsNotExist(err) && t.MustExistTimeout > 0 {
+			err = t.awaitFile(err)
+		}
 		if err != nil {
 			return nil, err
 		}
+	} else if t.Follow {
+		// Opened up front if it exists, for it to be watched from
+		// now on. Should this fail, it is opened by tailFileSync.
+		fi, err := t.stat(filename)
+		if err == nil && fi.Mode().IsRegular() {
+			t.open()
+		} else if os.IsNotExist(err) {
+			// All of it is written once tailing began.
+			t.startSize = 0
+		}
+	}
+	if t.Follow && t.file != nil && t.seekable() {
+		t.watchStart()
 	}
 
 	go t.tailFileSync()
@@ -82,181 +737,2677 @@ func TailFile(filename string, config Config) (*Tail, error) {
 	return t, nil
 }
 
-// Stop stops the tailing activity.
-func (tail *Tail) Stop() error {
-	tail.Kill(nil)
-	return tail.Wait()
+// FollowFile begins tailing the file as `tail -F` does, which is what
+// following a log most often calls for: from its end, through
+// rotations, and waiting for it to be created if need be. It is
+// TailFile with Follow, ReOpen and LocationEnd; the file is watched
+// with inotify, falling back to polling once out of inotify instances
+// or watches.
+func FollowFile(filename string) (*Tail, error) {
+	return TailFile(filename, Config{Follow: true, ReOpen: true, Location: LocationEnd})
 }
 
-func (tail *Tail) close() {
-	close(tail.Lines)
-	if tail.file != nil {
-		tail.file.Close()
+// ReadAllLines reads the lines of the file up to its end, without
+// following it, according to config otherwise, such as Location and
+// MaxLineSize. The file must exist, and events, batches and routes
+// are disabled. The error the tail ended with is returned along with
+// the lines read until then, or else the first error of the
+// LineParser, if any.
+func ReadAllLines(filename string, config Config) ([]*Line, error) {
+	config.Follow, config.ReOpen, config.FollowMode = false, false, FollowDefault
+	config.MustExist = true
+	config.ReportEvents, config.Batch, config.Routes = false, 0, nil
+	t, err := TailFile(filename, config)
+	if err != nil {
+		return nil, err
 	}
-}
 
-func (tail *Tail) reopen() error {
-	if tail.file != nil {
-		tail.file.Close()
-	}
-	for {
-		var err error
-		tail.file, err = os.Open(tail.Filename)
-		if err != nil {
-			if os.IsNotExist(err) {
-				log.Printf("Waiting for %s to appear...", tail.Filename)
-				if err := tail.watcher.BlockUntilExists(tail.Tomb); err != nil {
-					return fmt.Errorf("Failed to detect creation of %s: %s", tail.Filename, err)
-				}
+	var lines []*Line
+	var parseErr error
+	for t.Lines != nil || t.Errors != nil {
+		select {
+		case line, ok := <-t.Lines:
+			if !ok {
+				t.Lines = nil
 				continue
 			}
-			return fmt.Errorf("Unable to open file %s: %s", tail.Filename, err)
+			lines = append(lines, line)
+		case err, ok := <-t.Errors:
+			if !ok {
+				t.Errors = nil
+			} else if parseErr == nil {
+				parseErr = err
+			}
 		}
-		break
 	}
-	return nil
+	if err := t.Wait(); err != nil {
+		return lines, err
+	}
+	return lines, parseErr
 }
 
-func (tail *Tail) readLine() ([]byte, error) {
-	line, _, err := tail.reader.ReadLine()
-	return line, err
-}
+// TailReader begins reading lines from r, such as os.Stdin, in the
+// same way as TailFile does from a file. As a reader cannot be
+// watched or seeked, the tail ends once r reports EOF, Location and
+// NLines are ignored, and Reset has no effect. Stopping the tail does
+// not interrupt a pending Read, so Stop returns only once it completes;
+// StopWithTimeout closes r to interrupt it, if r is an io.Closer.
+func TailReader(r io.Reader, config Config) (*Tail, error) {
+	config.normalize()
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
 
-func (tail *Tail) tailFileSync() {
-	defer tail.Done()
-	defer tail.close()
+	var name string
+	if f, ok := r.(*os.File); ok {
+		name = f.Name()
+	}
+	t := newTail(name, config)
+	t.input = r
 
-	if !tail.MustExist {
-		// deferred first open.
-		err := tail.reopen()
-		if err != nil {
-			tail.Kill(err)
-			return
-		}
+	go t.tailFileSync()
+
+	return t, nil
+}
+
+// ValidateConfig checks that config is fit for tailing filename,
+// without tailing it, and returns an error describing the first
+// problem found. These are the errors TailFile would return, besides
+// the file having to exist and be readable when MustExist is set.
+func ValidateConfig(filename string, config Config) error {
+	config.normalize()
+	if err := config.validate(); err != nil {
+		return err
+	}
+	if !config.MustExist {
+		return nil
 	}
 
-	// Seek to requested location on first open of the file.
-	var offset int64
-	var whence int
-	if tail.Location >= 0 {
-		whence = 0
-		offset = int64(tail.Location)
+	fi, err := config.stat(filename)
+	if err != nil {
+		return err
+	}
+	switch {
+	case fi.Mode()&os.ModeNamedPipe != 0 && config.FS == nil:
+		// Opening a pipe would block until it has a writer.
+		return nil
+	case !fi.Mode().IsRegular():
+		return fmt.Errorf("%s: %w", filename, ErrNotRegularFile)
+	}
+	var file seekableFile
+	if config.FS != nil {
+		file, err = openFS(config.FS, filename)
 	} else {
-		whence = 2
-		offset = -1*int64(tail.Location) - 1
+		file, err = os.Open(filename)
 	}
-	_, err := tail.file.Seek(offset, whence) // Seek to the file beginning/end
 	if err != nil {
-		tail.Killf("Seek error on %s: %s", tail.Filename, err)
-		return
+		return err
 	}
+	defer file.Close()
+	if config.BinaryBehavior == BinaryRefuse && config.RecordSize == 0 {
+		if binary, err := isBinary(file); err != nil {
+			return err
+		} else if binary {
+			return fmt.Errorf("%s: %w", filename, ErrBinaryFile)
+		}
+	}
+	return nil
+}
 
-	tail.reader = bufio.NewReader(tail.file)
-
-	// Read line by line.
-	for {
-		line, err := tail.readLine()
+// stat returns the FileInfo of the named file, looked up in FS if set.
+func (config *Config) stat(name string) (os.FileInfo, error) {
+	if config.FS != nil {
+		return fs.Stat(config.FS, name)
+	}
+	return os.Stat(name)
+}
 
-		switch err {
-		case nil:
-			if line != nil {
-				tail.sendLine(line)
-			}
-		case io.EOF:
-			if !tail.Follow {
-				return
-			}
-			// When EOF is reached, wait for more data to become
-			// available. Wait strategy is based on the `tail.watcher`
-			// implementation (inotify or polling).
-			err := tail.waitForChanges()
-			if err != nil {
-				if err != ErrStop {
-					tail.Kill(err)
-				}
-				return
-			}
-		default: // non-EOF error
-			tail.Killf("Error reading %s: %s", tail.Filename, err)
-			return
-		}
+// openFS opens the named file of fsys, which must support seeking.
+func openFS(fsys fs.FS, name string) (seekableFile, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	sf, ok := f.(seekableFile)
+	if !ok {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", name, ErrNotSeekable)
+	}
+	return sf, nil
+}
 
-		select {
-		case <-tail.Dying():
-			return
-		default:
+// normalize sets Follow and ReOpen according to FollowMode, or the
+// other way around when FollowMode is not set.
+func (config *Config) normalize() {
+	switch config.FollowMode {
+	case FollowByName:
+		config.Follow, config.ReOpen = true, true
+	case FollowByDescriptor:
+		config.Follow, config.ReOpen = true, false
+	case FollowDefault:
+		if config.Follow && config.ReOpen {
+			config.FollowMode = FollowByName
+		} else if config.Follow {
+			config.FollowMode = FollowByDescriptor
 		}
 	}
 }
 
-// waitForChanges waits until the file has been appended, deleted,
-// moved or truncated. When moved or deleted - the file will be
-// reopened if ReOpen is true. Truncated files are always reopened.
-func (tail *Tail) waitForChanges() error {
-	if tail.changes == nil {
-		st, err := tail.file.Stat()
-		if err != nil {
-			return err
-		}
-		tail.changes = tail.watcher.ChangeEvents(tail.Tomb, st)
+// validate checks the settings of a normalized config for consistency.
+func (config *Config) validate() error {
+	switch {
+	case config.FollowMode < FollowDefault || config.FollowMode > FollowByName:
+		return fmt.Errorf("invalid FollowMode: %d", config.FollowMode)
+	case config.ReOpen && !config.Follow:
+		return ErrReOpenRequiresFollow
+	case config.MaxLineSize < 0:
+		return fmt.Errorf("%w: %d", ErrInvalidMaxLineSize, config.MaxLineSize)
+	case config.NLines < 0:
+		return fmt.Errorf("invalid NLines: %d", config.NLines)
+	case config.RecordSize < 0:
+		return fmt.Errorf("invalid RecordSize: %d", config.RecordSize)
+	case config.PollHashSize < 0:
+		return fmt.Errorf("invalid PollHashSize: %d", config.PollHashSize)
+	case config.PollMinInterval < 0 || config.PollMaxInterval < 0:
+		return fmt.Errorf("invalid PollMinInterval or PollMaxInterval: %s, %s", config.PollMinInterval, config.PollMaxInterval)
+	case (config.PollMinInterval > 0) != (config.PollMaxInterval > 0):
+		return fmt.Errorf("cannot set only one of PollMinInterval and PollMaxInterval")
+	case config.PollMinInterval > config.PollMaxInterval:
+		return fmt.Errorf("PollMinInterval %s exceeds PollMaxInterval %s", config.PollMinInterval, config.PollMaxInterval)
+	case config.InotifyCheckInterval < 0:
+		return fmt.Errorf("invalid InotifyCheckInterval: %s", config.InotifyCheckInterval)
+	case config.ReplayBuffer < 0:
+		return fmt.Errorf("invalid ReplayBuffer: %d", config.ReplayBuffer)
+	case config.ReaderBufferSize < 0:
+		return fmt.Errorf("invalid ReaderBufferSize: %d", config.ReaderBufferSize)
+	case config.Location != 0 && config.NLines > 0:
+		return fmt.Errorf("cannot set both Location and NLines")
+	case config.Location != 0 && !config.StartTime.IsZero():
+		return fmt.Errorf("cannot set both Location and StartTime")
+	case !config.StartTime.IsZero() && config.TimeParser == nil:
+		return fmt.Errorf("cannot set StartTime without TimeParser")
+	case config.StartPercent < 0 || config.StartPercent > 100:
+		return fmt.Errorf("invalid StartPercent: %g", config.StartPercent)
+	case config.StartPercent > 0 && (config.Location != 0 || config.NLines > 0 || !config.StartTime.IsZero()):
+		return fmt.Errorf("cannot set StartPercent along with Location, NLines or StartTime")
+	case config.StartLine < 0:
+		return fmt.Errorf("invalid StartLine: %d", config.StartLine)
+	case config.StartLine > 0 && (config.Location != 0 || config.NLines > 0 || !config.StartTime.IsZero() || config.StartPercent > 0 || config.RecordSize > 0):
+		return fmt.Errorf("cannot set StartLine along with Location, NLines, StartTime, StartPercent or RecordSize")
+	case config.Resume != nil && config.Resume.Offset < 0:
+		return fmt.Errorf("invalid Resume offset: %d", config.Resume.Offset)
+	case config.Resume != nil && (config.Location != 0 || config.NLines > 0 || !config.StartTime.IsZero() || config.StartPercent > 0 || config.StartLine > 0):
+		return fmt.Errorf("cannot set Resume along with Location, NLines, StartTime, StartPercent or StartLine")
+	case config.FS != nil && !config.Poll && config.WatcherFactory == nil:
+		return fmt.Errorf("cannot set FS without Poll or WatcherFactory")
+	case config.FS != nil && config.FollowSymlinks:
+		return fmt.Errorf("cannot set both FS and FollowSymlinks")
+	case len(config.Routes) > 0 && config.Batch > 1:
+		return fmt.Errorf("cannot set both Routes and Batch")
+	case config.LineEnding < LineEndingLF || config.LineEnding > LineEndingAuto:
+		return fmt.Errorf("invalid LineEnding: %d", config.LineEnding)
+	case len(config.Delimiters) > 0 && config.LineEnding != LineEndingLF:
+		return fmt.Errorf("cannot set both Delimiters and LineEnding")
+	case len(config.Delimiters) > 0 && (config.NLines > 0 || !config.StartTime.IsZero() || config.StartPercent > 0 || config.StartLine > 0 || config.MaxLag > 0):
+		return fmt.Errorf("cannot set Delimiters along with NLines, StartTime, StartPercent, StartLine or MaxLag")
+	case config.SkipHeaderLines < 0:
+		return fmt.Errorf("invalid SkipHeaderLines: %d", config.SkipHeaderLines)
+	case config.MaxOpenFiles < 0:
+		return fmt.Errorf("invalid MaxOpenFiles: %d", config.MaxOpenFiles)
+	case config.MaxOpenFiles > 0 && !config.ReOpen:
+		return fmt.Errorf("cannot set MaxOpenFiles without ReOpen")
+	case config.MaxOpenFiles > 0 && config.FollowMode == FollowByDescriptor:
+		return fmt.Errorf("cannot set MaxOpenFiles with FollowByDescriptor")
+	case config.ReleaseFDWhenIdle > 0 && !config.ReOpen:
+		return fmt.Errorf("cannot set ReleaseFDWhenIdle without ReOpen")
+	case config.ReleaseFDWhenIdle > 0 && config.FollowMode == FollowByDescriptor:
+		return fmt.Errorf("cannot set ReleaseFDWhenIdle with FollowByDescriptor")
 	}
+	return nil
+}
 
-	select {
-	case <-tail.changes.Modified:
-		return nil
-	case <-tail.changes.Deleted:
-		tail.changes = nil
-		if tail.ReOpen {
-			// XXX: we must not log from a library.
-			log.Printf("Re-opening moved/deleted file %s ...", tail.Filename)
-			if err := tail.reopen(); err != nil {
-				return err
-			}
-			log.Printf("Successfully reopened %s", tail.Filename)
-			tail.reader = bufio.NewReader(tail.file)
-			return nil
-		} else {
-			log.Printf("Stopping tail as file no longer exists: %s", tail.Filename)
-			return ErrStop
-		}
-	case <-tail.changes.Truncated:
-		// Always reopen truncated files (Follow is true)
-		log.Printf("Re-opening truncated file %s ...", tail.Filename)
-		if err := tail.reopen(); err != nil {
-			return err
-		}
-		log.Printf("Successfully reopened truncated %s", tail.Filename)
-		tail.reader = bufio.NewReader(tail.file)
-		return nil
-	case <-tail.Dying():
-		return ErrStop
+// newInotifyWatcher creates the inotify watcher of a file; tests
+// replace it to simulate failures.
+var newInotifyWatcher = func(filename string) (watch.FileWatcher, error) {
+	fw, err := watch.NewInotifyFileWatcher(filename)
+	if err != nil {
+		return nil, err
+	}
+	return fw, nil
+}
+
+// pollingWatcher returns a watcher polling the file, according to the
+// clock of the tail.
+func (tail *Tail) pollingWatcher() watch.FileWatcher {
+	fw, _ := watch.NewPollingFileWatcher(tail.Filename)
+	fw.Clock = tail.clock
+	fw.FS = tail.FS
+	fw.HashSize = tail.PollHashSize
+	fw.MinInterval, fw.MaxInterval = tail.PollMinInterval, tail.PollMaxInterval
+	tail.mu.Lock()
+	fw.SetInterval(tail.pollInterval)
+	tail.mu.Unlock()
+	return fw
+}
+
+// watchStart registers the watcher on the file opened by TailFile,
+// and notes its size, for the data written once TailFile returns not
+// to be skipped by the initial seek, such as to its end.
+func (tail *Tail) watchStart() {
+	fi, err := tail.file.Stat()
+	if err != nil {
+		return // Watched once EOF is reached.
+	}
+	tail.startSize = fi.Size()
+	tail.watchChanges(fi) // Retried, and reported, once EOF is reached.
+}
+
+// watchChanges registers the watcher on the file, as described by fi.
+// Once out of inotify instances or watches, the file is polled instead.
+func (tail *Tail) watchChanges(fi os.FileInfo) error {
+	changes, err := tail.watcher.ChangeEvents(&tail.Tomb, fi)
+	if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENOSPC) {
+		log.Printf("Falling back to polling %s: %s", tail.Filename, err)
+		fw := tail.pollingWatcher()
+		tail.mu.Lock()
+		tail.watcher = fw
+		tail.mu.Unlock()
+		changes, err = fw.ChangeEvents(&tail.Tomb, fi)
+	}
+	if err != nil {
+		return &TailError{tail.Filename, "watch", err}
+	}
+	tail.changes = changes
+	return nil
+}
+
+// newTail returns a Tail set up according to config, which is yet to
+// be given its source.
+func newTail(filename string, config Config) *Tail {
+	t := &Tail{
+		Filename: filename,
+		Lines:    make(chan *Line),
+		resets:   make(chan bool, 1),
+		resyncs:  make(chan bool, 1),
+		release:  make(chan bool, 1),
+		finish:   make(chan bool, 1),
+		started:  make(chan struct{}),
+		stopped:  make(chan struct{}),
+		ending:   config.LineEnding,
+		Config:   config}
+	t.startSize = -1
+
+	if t.ending == LineEndingAuto {
+		// Until a file is opened to be sniffed.
+		t.ending = LineEndingLF
+	}
+	for _, c := range t.Delimiters {
+		t.delims[c] = true
+	}
+	if t.ReportEvents {
+		t.Events = make(chan Event)
+	}
+	if t.LineParser != nil {
+		t.Errors = make(chan error)
+	}
+	if len(t.Routes) > 0 {
+		t.Routed = make(map[string]chan *Line)
+		for _, route := range t.Routes {
+			t.Routed[route] = make(chan *Line)
+		}
+	}
+	if t.Batch > 1 {
+		t.Batches = make(chan []*Line)
+		if t.BatchTimeout <= 0 {
+			t.BatchTimeout = defaultBatchTimeout
+		}
+	}
+
+	t.clock = watch.RealClock
+	if t.Clock != nil {
+		t.clock = t.Clock
+	}
+	return t
+}
+
+// Stop stops the tailing activity.
+func (tail *Tail) Stop() error {
+	tail.stop()
+	return tail.Wait()
+}
+
+// StopWithTimeout stops the tailing activity, waiting for at most d
+// for it to end. Should it not end in time, such as when blocked in a
+// Read, the file is closed to unblock it, or the reader given to
+// TailReader if an io.Closer, and ErrStopTimeout is returned, without
+// waiting further.
+func (tail *Tail) StopWithTimeout(d time.Duration) error {
+	tail.stop()
+	select {
+	case <-tail.Dead():
+		return tail.Err()
+	case <-tail.clock.After(d):
+	}
+	// The file is left set for the read loop to release.
+	tail.mu.Lock()
+	if tail.file != nil {
+		tail.file.Close()
+	}
+	tail.mu.Unlock()
+	if c, ok := tail.input.(io.Closer); ok {
+		c.Close()
+	}
+	return ErrStopTimeout
+}
+
+// Close stops the tailing activity without waiting for it to end, so
+// that it can be deferred where blocking is not desirable. The file
+// and watcher are released as the tail ends, whether or not `Wait` is
+// called; its outcome can be obtained later with `Wait` or `Err`.
+// Close always returns nil, and makes a Tail an io.Closer.
+func (tail *Tail) Close() error {
+	tail.stop()
+	return nil
+}
+
+// stop kills the tail, recording that it was stopped rather than
+// ended of itself, as the tomb is dying either way, for DecodeJSON to
+// no longer deliver values.
+func (tail *Tail) stop() {
+	tail.stopOnce.Do(func() { close(tail.stopped) })
+	tail.Kill(nil)
+}
+
+// Next blocks until the next line is available, the context is
+// cancelled or the tail ends. When the tail ended cleanly io.EOF is
+// returned, otherwise the error the tail died with. Next is meant to
+// be called from a single consumer goroutine, in place of ranging
+// over `Tail.Lines`.
+func (tail *Tail) Next(ctx context.Context) (*Line, error) {
+	select {
+	case line, ok := <-tail.Lines:
+		if ok {
+			return line, nil
+		}
+		// Lines is closed just before the tomb is marked as dead.
+		if err := tail.Wait(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// All returns an iterator over the lines of the tail, to be used in
+// place of ranging over `Tail.Lines`. Should the tail die with an
+// error, it is yielded last, along with a nil line. Breaking out of
+// the iteration stops the tail.
+func (tail *Tail) All() iter.Seq2[*Line, error] {
+	return func(yield func(*Line, error) bool) {
+		for line := range tail.Lines {
+			if !yield(line, nil) {
+				tail.Close()
+				return
+			}
+		}
+		if err := tail.Wait(); err != nil {
+			yield(nil, err)
+		}
+	}
+}
+
+// Reset rewinds the file to its beginning, so that its entire
+// content is read again, while continuing to follow it. It is safe to
+// call concurrently with the tailing activity: the rewind is carried
+// out by the read loop, so a Reset requested while the file is being
+// reopened applies to the newly opened file. Pipes and readers cannot
+// be rewound, and are not affected.
+func (tail *Tail) Reset() {
+	select {
+	case tail.resets <- true:
+	default:
+	}
+}
+
+// stopAtEOF has the tail end once it has read up to the end of the
+// file, as if not following it, delivering the lines held back, if
+// any, beforehand. It is safe to call concurrently with the tailing
+// activity.
+func (tail *Tail) stopAtEOF() {
+	tail.finishing.Store(true)
+	select {
+	case tail.finish <- true:
+	default:
+	}
+}
+
+// Resync has reading continue from the current offset of the file,
+// discarding the data read ahead of the lines emitted so far, for the
+// file to be seeked to by other means than the tail. Like Reset, it is
+// safe to call concurrently with the tailing activity, and carried out
+// by the read loop, once done with the line at hand. Pipes and readers
+// are not affected.
+func (tail *Tail) Resync() {
+	select {
+	case tail.resyncs <- true:
+	default:
+	}
+}
+
+func (tail *Tail) close() {
+	tail.stopChanges()
+	tail.flushRepeated()
+	tail.flushBatch()
+	close(tail.Lines)
+	if tail.Batches != nil {
+		close(tail.Batches)
+	}
+	if tail.Events != nil {
+		close(tail.Events)
+	}
+	if tail.Errors != nil {
+		close(tail.Errors)
+	}
+	for _, ch := range tail.Routed {
+		close(ch)
+	}
+	tail.closeFile()
+}
+
+func (tail *Tail) reopen() error {
+	// Lines of the previous file are not held back while waiting
+	// for the new one.
+	tail.flushRepeated()
+	tail.flushBatch()
+	tail.closeFile()
+	old := tail.opened
+	var isDir bool // The path was found to be a directory
+	for {
+		err := tail.open()
+		if err != nil {
+			if os.IsNotExist(err) {
+				log.Printf("Waiting for %s to appear...", tail.Filename)
+				err := watch.BlockUntilExistsTimeout(tail.watcher, &tail.Tomb, tail.WaitTimeout)
+				if err == tomb.ErrDying {
+					// Stopped, which is not to be reported as
+					// an error; killing with it changes nothing.
+					return err
+				} else if err != nil {
+					return &TailError{tail.Filename, "watch", err}
+				}
+				continue
+			}
+			if tail.ReOpen && errors.Is(err, ErrPathIsDirectory) && !isDir {
+				log.Printf("Waiting for %s to be a file rather than a directory...", tail.Filename)
+				isDir = true
+			}
+			if tail.ReOpen && errors.Is(err, ErrPathIsDirectory) ||
+				tail.RetryOnPermissionDenied && !tail.fifo && errors.Is(err, os.ErrPermission) {
+				select {
+				case <-tail.clock.After(tail.getPollInterval()):
+					continue
+				case <-tail.Dying():
+					return tomb.ErrDying
+				}
+			}
+			return &TailError{tail.Filename, "open", err}
+		}
+		break
+	}
+	tail.resetCheckpoint(0)
+	tail.skipReopenedHeader()
+	tail.reopened(old)
+	return nil
+}
+
+// reopened calls OnReopen, if set, for the file just opened in place
+// of that of old.
+func (tail *Tail) reopened(old os.FileInfo) {
+	if tail.OnReopen != nil {
+		tail.OnReopen(old, tail.opened)
+	}
+}
+
+// skipReopenedHeader sets the header lines to skip of a file opened
+// anew, per SkipHeaderOnReopen.
+func (tail *Tail) skipReopenedHeader() {
+	tail.headerLeft = 0
+	if tail.SkipHeaderOnReopen {
+		tail.headerLeft = tail.SkipHeaderLines
+	}
+}
+
+// newFileReader returns the reader through which the file is read;
+// tests replace it to inject read errors.
+var newFileReader = func(file io.Reader) io.Reader { return file }
+
+// open opens the file, noting whether it is a named pipe, and checks
+// that it is one or a regular file. Files of FS are never taken for
+// pipes.
+func (tail *Tail) open() error {
+	fi, err := tail.stat(tail.Filename)
+	tail.fifo = tail.FS == nil && err == nil && fi.Mode()&os.ModeNamedPipe != 0
+	var file seekableFile
+	switch {
+	case tail.FS != nil:
+		file, err = openFS(tail.FS, tail.Filename)
+	case tail.fifo:
+		file, err = tail.openFIFO()
+	default:
+		file, err = os.Open(tail.Filename)
+	}
+	if err != nil {
+		return err
+	}
+
+	fi, err = file.Stat()
+	if err == nil && fi.IsDir() {
+		err = fmt.Errorf("%s: %w", tail.Filename, ErrPathIsDirectory)
+	} else if err == nil && !fi.Mode().IsRegular() && !tail.fifo {
+		err = fmt.Errorf("%s: %w", tail.Filename, ErrNotRegularFile)
+	}
+	tail.hexdump = false
+	if err == nil && tail.BinaryBehavior != BinaryAllow && tail.RecordSize == 0 && !tail.fifo {
+		var binary bool
+		binary, err = isBinary(file)
+		switch {
+		case err != nil:
+		case binary && tail.BinaryBehavior == BinaryRefuse:
+			err = fmt.Errorf("%s: %w", tail.Filename, ErrBinaryFile)
+		case binary:
+			tail.hexdump = true
+		}
+	}
+	if err == nil && tail.LineEnding == LineEndingAuto && !tail.fifo {
+		tail.ending, err = sniffLineEnding(file)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	tail.mu.Lock()
+	tail.file = file
+	tail.mu.Unlock()
+	tail.opened = fi
+	return nil
+}
+
+// isBinary tells whether the file looks binary from its beginning,
+// without changing its offset.
+func isBinary(f io.ReaderAt) (bool, error) {
+	buf := make([]byte, binarySniffSize)
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	var control int
+	for _, b := range buf[:n] {
+		switch {
+		case b == 0:
+			return true, nil
+		case b == 0x7f || (b < 0x20 && strings.IndexByte("\t\n\v\f\r\b\x1b", b) < 0):
+			control++
+		}
+	}
+	return n > 0 && control*2 > n, nil
+}
+
+// sniffLineEnding tells the line ending of the file from its
+// beginning, for LineEndingAuto, without changing its offset.
+func sniffLineEnding(f io.ReaderAt) (LineEnding, error) {
+	buf := make([]byte, lineEndingSniffSize)
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return LineEndingLF, err
+	}
+	buf = buf[:n]
+	if i := bytes.IndexAny(buf, "\r\n"); i >= 0 && i+1 < n && buf[i] == '\r' && buf[i+1] != '\n' {
+		return LineEndingCR, nil
+	}
+	return LineEndingLF, nil
+}
+
+// awaitFile opens the file once it is created, waiting for up to
+// MustExistTimeout. Should it not appear in time, notExist, the error
+// from the first attempt to open it, is returned.
+func (tail *Tail) awaitFile(notExist error) error {
+	var deadline tomb.Tomb
+	expired := tail.clock.After(tail.MustExistTimeout)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-expired:
+			deadline.Kill(nil)
+		case <-done:
+		}
+	}()
+
+	for {
+		if err := tail.watcher.BlockUntilExists(&deadline); err == tomb.ErrDying {
+			return notExist
+		} else if err != nil {
+			return err
+		}
+		if err := tail.open(); !os.IsNotExist(err) {
+			return err
+		}
+	}
+}
+
+// closeFile closes the current file, if any.
+func (tail *Tail) closeFile() {
+	tail.mu.Lock()
+	defer tail.mu.Unlock()
+	if tail.file != nil {
+		tail.file.Close()
+		tail.file = nil
+	}
+}
+
+// FileInfo returns the FileInfo of the file currently being tailed,
+// which is the new file once it has been reopened. ErrNoFile is
+// returned while no file is open, such as when waiting for the file
+// to be recreated. It is safe to call while the tail is running.
+func (tail *Tail) FileInfo() (os.FileInfo, error) {
+	tail.mu.Lock()
+	defer tail.mu.Unlock()
+	if tail.file == nil {
+		return nil, ErrNoFile
+	}
+	return tail.file.Stat()
+}
+
+// openFIFO opens the named pipe, which blocks until a writer opens it
+// as well. Stopping the tail meanwhile unblocks the open by briefly
+// opening the pipe for writing.
+func (tail *Tail) openFIFO() (*os.File, error) {
+	opened := make(chan struct{})
+	defer close(opened)
+	go func() {
+		select {
+		case <-tail.Dying():
+		case <-opened:
+			return
+		}
+		for {
+			w, err := os.OpenFile(tail.Filename, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+			if err == nil {
+				w.Close()
+			}
+			select {
+			case <-opened:
+				return
+			case <-tail.clock.After(10 * time.Millisecond):
+			}
+		}
+	}()
+	return os.Open(tail.Filename)
+}
+
+// fifoReader reads from a named pipe with a deadline, so that the read
+// loop regularly gets to check whether the tail is stopping while no
+// data is written.
+type fifoReader struct {
+	file *os.File
+}
+
+func (r fifoReader) Read(p []byte) (int, error) {
+	r.file.SetReadDeadline(time.Now().Add(watch.POLL_DURATION))
+	return r.file.Read(p)
+}
+
+// timeoutReader reads from a goroutine, which is abandoned should it
+// take longer than timeout. Its result is then that of the next read.
+type timeoutReader struct {
+	r       io.Reader
+	file    io.Seeker // Read by r, for settle to restore its offset
+	timeout time.Duration
+	clock   watch.Clock
+	pending chan timedRead // Read in progress, if any
+	rest    []byte         // Data of the last read not returned yet
+	err     error          // Error of the last read, returned after rest
+	end     int64          // Offset of the file past rest
+}
+
+type timedRead struct {
+	data []byte
+	err  error
+	end  int64
+}
+
+func (r *timeoutReader) Read(p []byte) (int, error) {
+	if r.pending == nil && len(r.rest) == 0 && r.err == nil {
+		// The goroutine reads into a buffer of its own, as p may
+		// no longer be in use by the time it returns.
+		buf := make([]byte, len(p))
+		pending := make(chan timedRead, 1)
+		go func() {
+			n, err := r.r.Read(buf)
+			end, _ := r.file.Seek(0, io.SeekCurrent)
+			pending <- timedRead{buf[:n], err, end}
+		}()
+		r.pending = pending
+	}
+	if r.pending != nil {
+		select {
+		case res := <-r.pending:
+			r.pending = nil
+			r.rest, r.err, r.end = res.data, res.err, res.end
+		case <-r.clock.After(r.timeout):
+			return 0, ErrReadTimeout
+		}
+	}
+	n := copy(p, r.rest)
+	r.rest = r.rest[n:]
+	if len(r.rest) > 0 {
+		return n, nil
+	}
+	err := r.err
+	r.err = nil
+	return n, err
+}
+
+// settle waits for the read in progress, if any, to end, and discards
+// what was read but not returned, as the file is about to be seeked.
+// The offset of the file is moved back before that data, unless the
+// file was seeked meanwhile, such as ahead of Resync. It returns false
+// if dying is closed first.
+func (r *timeoutReader) settle(dying <-chan struct{}) (bool, error) {
+	if r.pending != nil {
+		select {
+		case res := <-r.pending:
+			r.pending = nil
+			r.rest, r.end = res.data, res.end
+		case <-dying:
+			return false, nil
+		}
+	}
+	unread := int64(len(r.rest))
+	r.rest, r.err = nil, nil
+	if unread == 0 {
+		return true, nil
+	}
+	if offset, err := r.file.Seek(0, io.SeekCurrent); err != nil || offset != r.end {
+		return true, err
+	}
+	_, err := r.file.Seek(-unread, io.SeekCurrent)
+	return true, err
+}
+
+// preloadMaxSize is the size of the files read whole per Preload, and
+// the most read of them at once.
+const preloadMaxSize = 1 << 20
+
+// preloadable tells whether the file is to be read per Preload.
+func (tail *Tail) preloadable() bool {
+	if !tail.Preload {
+		return false
+	}
+	fi, err := tail.file.Stat()
+	return err == nil && fi.Size() <= preloadMaxSize
+}
+
+// preloadReader reads the file from offset up to its end, as it is at
+// the time, in a single read, to then serve reads from memory until
+// it is all read, per Preload. It reads at offsets, leaving the offset
+// of the file unchanged.
+type preloadReader struct {
+	file   seekableFile
+	offset int64
+	buf    []byte
+}
+
+func (r *preloadReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		fi, err := r.file.Stat()
+		if err != nil {
+			return 0, err
+		}
+		n := min(fi.Size()-r.offset, preloadMaxSize)
+		if n <= 0 {
+			return 0, io.EOF
+		}
+		buf := make([]byte, n)
+		m, err := r.file.ReadAt(buf, r.offset)
+		if m == 0 {
+			return 0, err
+		}
+		r.buf = buf[:m]
+		r.offset += int64(m)
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// offsetReader tracks the offset in the file as it is read.
+type offsetReader struct {
+	r      io.Reader
+	offset int64
+}
+
+func (r *offsetReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+// settleRead waits for a read abandoned per ReadTimeout to end, for it
+// not to move the offset of the file once seeked, nor its data to be
+// taken for that at the new offset. It returns ErrStop if the tail is
+// stopped meanwhile.
+func (tail *Tail) settleRead() error {
+	if tail.src == nil {
+		return nil
+	}
+	r, ok := tail.src.r.(*timeoutReader)
+	if !ok {
+		return nil
+	}
+	settled, err := r.settle(tail.Dying())
+	if !settled {
+		return ErrStop
+	}
+	return err
+}
+
+// resetReader starts reading from offset, the current offset of the
+// file, discarding any buffered data.
+func (tail *Tail) resetReader(offset int64) {
+	var r io.Reader
+	switch {
+	case tail.input != nil:
+		r = tail.input
+	case tail.fifo:
+		r = fifoReader{tail.file.(*os.File)}
+	case tail.preloadable():
+		r = &preloadReader{file: tail.file, offset: offset}
+	default:
+		r = newFileReader(tail.file)
+		if tail.ReadTimeout > 0 {
+			r = &timeoutReader{r: r, file: tail.file,
+				timeout: tail.ReadTimeout, clock: tail.clock}
+		}
+	}
+	tail.src = &offsetReader{r, offset}
+	if tail.ReaderBufferSize > 0 {
+		tail.reader = bufio.NewReaderSize(tail.src, tail.ReaderBufferSize)
+	} else {
+		tail.reader = bufio.NewReader(tail.src)
+	}
+	tail.partial = nil
+	tail.wakeupOffset = -1
+	tail.updatePosition()
+}
+
+// updatePosition publishes the current read offset for Position.
+func (tail *Tail) updatePosition() {
+	offset := tail.tell() - int64(len(tail.partial))
+	tail.mu.Lock()
+	tail.position = offset
+	tail.mu.Unlock()
+}
+
+// Position returns the offset in the file up to which lines have been
+// read; right after the tail started, this is the offset at which
+// tailing began. The offset restarts from 0 whenever the file is
+// reopened. It is safe to call while the tail is running, but returns
+// ErrNotStarted until the file has been opened and seeked to the
+// requested location, as signaled by `Started`.
+func (tail *Tail) Position() (int64, error) {
+	select {
+	case <-tail.started:
+	default:
+		return 0, ErrNotStarted
+	}
+	tail.mu.Lock()
+	defer tail.mu.Unlock()
+	return tail.position, nil
+}
+
+// CaughtUp reports whether the tail has read all the data written to
+// the file so far, as opposed to still working through a backlog. It
+// becomes false again while a burst of new data is being read. It is
+// safe to call while the tail is running.
+func (tail *Tail) CaughtUp() bool {
+	tail.mu.Lock()
+	defer tail.mu.Unlock()
+	return tail.caughtUp
+}
+
+func (tail *Tail) setCaughtUp(caughtUp bool) {
+	tail.mu.Lock()
+	tail.caughtUp = caughtUp
+	tail.mu.Unlock()
+}
+
+// Commit acknowledges that the lines up to offset, as given by
+// `Line.Offset`, have been processed, for Checkpoint to account for.
+// Committing lines out of order is fine: offsets lower than one
+// already committed are ignored. It is safe to call concurrently with
+// the tailing activity.
+func (tail *Tail) Commit(offset int64) {
+	tail.mu.Lock()
+	defer tail.mu.Unlock()
+	if offset > tail.commit {
+		tail.commit = offset
+	}
+}
+
+// Checkpoint returns the offset from which tailing can safely resume,
+// such as through Location, with no line left unprocessed: the
+// highest offset committed, or where tailing began if none was. Like
+// Position, the offset is that in the current file, and restarts from
+// 0 once the file is reopened or rewound; lines of the previous file
+// committed afterwards are ignored. It is safe to call while the tail
+// is running.
+func (tail *Tail) Checkpoint() int64 {
+	tail.mu.Lock()
+	defer tail.mu.Unlock()
+	return tail.commit
+}
+
+// ResumeInfo returns Checkpoint along with the fingerprint of the file,
+// to be set as `Config.Resume` to resume tailing the file once the
+// tail is started anew. It is safe to call while the tail is running,
+// but returns ErrNoFile while no file is open, and fails for pipes.
+func (tail *Tail) ResumeInfo() (ResumeInfo, error) {
+	tail.mu.Lock()
+	defer tail.mu.Unlock()
+	if tail.file == nil {
+		return ResumeInfo{}, ErrNoFile
+	}
+	sum, err := fingerprint(tail.file, tail.commit)
+	if err != nil {
+		return ResumeInfo{}, err
+	}
+	return ResumeInfo{Offset: tail.commit, Fingerprint: sum}, nil
+}
+
+// fingerprint returns the SHA-256 hash of the bytes of f up to offset,
+// or up to fingerprintSize.
+func fingerprint(f io.ReaderAt, offset int64) ([]byte, error) {
+	buf := make([]byte, min(offset, fingerprintSize))
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(buf)
+	return sum[:], nil
+}
+
+// resetCheckpoint restarts Checkpoint from offset, as the file is
+// read from there anew.
+func (tail *Tail) resetCheckpoint(offset int64) {
+	tail.mu.Lock()
+	tail.commit = offset
+	tail.mu.Unlock()
+}
+
+// LostBytes returns an estimate of the bytes left unread in files
+// moved or deleted while tailed, in total since the tail started, as
+// reported by `Event.Lost`. It is safe to call while the tail is
+// running.
+func (tail *Tail) LostBytes() int64 {
+	tail.mu.Lock()
+	defer tail.mu.Unlock()
+	return tail.lost
+}
+
+// Recent returns the last lines emitted, up to ReplayBuffer of them,
+// from the oldest. The lines are those sent on Lines rather than
+// copies, and must not be modified. It is safe to call while the tail
+// is running.
+func (tail *Tail) Recent() []*Line {
+	tail.mu.Lock()
+	defer tail.mu.Unlock()
+	recent := make([]*Line, 0, len(tail.recent))
+	recent = append(recent, tail.recent[tail.oldest:]...)
+	return append(recent, tail.recent[:tail.oldest]...)
+}
+
+// remember retains the line for Recent, in place of the oldest one
+// once ReplayBuffer lines are.
+func (tail *Tail) remember(line *Line) {
+	tail.mu.Lock()
+	defer tail.mu.Unlock()
+	if len(tail.recent) < tail.ReplayBuffer {
+		tail.recent = append(tail.recent, line)
+		return
+	}
+	tail.recent[tail.oldest] = line
+	tail.oldest = (tail.oldest + 1) % len(tail.recent)
+}
+
+// Started returns a channel that is closed once the file has been
+// opened and seeked to the requested location.
+func (tail *Tail) Started() <-chan struct{} {
+	return tail.started
+}
+
+// Running reports whether the tail is running, which it no longer is
+// once it is stopping or has ended, without blocking. Dead returns a
+// channel that is closed once it has ended, to select on.
+func (tail *Tail) Running() bool {
+	select {
+	case <-tail.Dying():
+		return false
+	default:
+		return true
+	}
+}
+
+// SetPollInterval changes how often the file is polled for changes,
+// taking effect from the next poll; zero or less restores
+// watch.POLL_DURATION. Besides polling watchers, this applies to the
+// checks of FollowSymlinks and of files renamed while following by
+// descriptor. It is safe to call while the tail is running.
+func (tail *Tail) SetPollInterval(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	tail.mu.Lock()
+	defer tail.mu.Unlock()
+	tail.pollInterval = d
+	if fw, ok := tail.watcher.(*watch.PollingFileWatcher); ok {
+		fw.SetInterval(d)
+	}
+}
+
+// getPollInterval returns how often the file is polled.
+func (tail *Tail) getPollInterval() time.Duration {
+	tail.mu.Lock()
+	defer tail.mu.Unlock()
+	if tail.pollInterval > 0 {
+		return tail.pollInterval
+	}
+	return watch.POLL_DURATION
+}
+
+// SetRateLimit changes RateLimit, the maximum number of lines emitted
+// per second, with zero or less lifting the limit. It takes effect
+// from the line after the one being emitted. It is safe to call while
+// the tail is running, unlike assigning RateLimit directly.
+func (tail *Tail) SetRateLimit(r float64) {
+	tail.mu.Lock()
+	tail.RateLimit = r
+	tail.mu.Unlock()
+}
+
+// getRateLimit returns RateLimit, as changed by SetRateLimit.
+func (tail *Tail) getRateLimit() float64 {
+	tail.mu.Lock()
+	defer tail.mu.Unlock()
+	return tail.RateLimit
+}
+
+// SetMaxLineSize changes MaxLineSize, the size beyond which lines are
+// split, with zero or less lifting the limit. It takes effect from the
+// next line read. It is safe to call while the tail is running, unlike
+// assigning MaxLineSize directly.
+func (tail *Tail) SetMaxLineSize(n int) {
+	tail.mu.Lock()
+	tail.MaxLineSize = n
+	tail.mu.Unlock()
+}
+
+// getMaxLineSize returns MaxLineSize, as changed by SetMaxLineSize.
+func (tail *Tail) getMaxLineSize() int {
+	tail.mu.Lock()
+	defer tail.mu.Unlock()
+	return tail.MaxLineSize
+}
+
+// recordSize returns the size of the records the file is read as, or
+// 0 if it is read as lines.
+func (tail *Tail) recordSize() int {
+	if tail.hexdump {
+		return hexdumpWidth
+	}
+	return tail.RecordSize
+}
+
+// next reads the next line or record, keeping track of the offset.
+func (tail *Tail) next() ([]byte, error) {
+	var line []byte
+	var err error
+	before := tail.tell()
+	if tail.recordSize() > 0 {
+		line, err = tail.readRecord()
+	} else {
+		line, err = tail.readLine()
+	}
+	tail.bytesRead += tail.tell() - before
+	tail.updatePosition()
+	return line, err
+}
+
+// drain emits the lines left in the file up to its end, before it is
+// let go for the file that replaced it, for lines to be emitted in the
+// order they were written. It stops at the first error, the bytes left
+// unread then being reported as lost.
+func (tail *Tail) drain() {
+	if tail.file == nil {
+		return
+	}
+	for {
+		line, err := tail.next()
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Failed to read the rest of %s: %s", tail.Filename, err)
+			}
+			return
+		}
+		if line != nil && !tail.headerLine() {
+			tail.sendLine(line)
+		}
+	}
+}
+
+// headerLine tells whether a line just read is one of the header lines
+// to skip per SkipHeaderLines, counting it as such.
+func (tail *Tail) headerLine() bool {
+	if tail.headerLeft <= 0 || tail.recordSize() > 0 {
+		return false
+	}
+	tail.headerLeft--
+	return true
+}
+
+// readRecord reads the next record of RecordSize bytes. A partial
+// record at EOF is kept until the rest of it is written.
+func (tail *Tail) readRecord() ([]byte, error) {
+	buf := make([]byte, tail.recordSize()-len(tail.partial))
+	n, err := io.ReadFull(tail.reader, buf)
+	tail.partial = append(tail.partial, buf[:n]...)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	record := tail.partial
+	tail.partial = nil
+	return record, nil
+}
+
+// readLine reads the next line from the file, along with its line
+// terminator. Lines longer than the bufio buffer are accumulated until
+// the full line is assembled; removing the terminator and splitting
+// according to MaxLineSize are left to sendLine. If reading fails
+// mid-line, the part read so far is kept so that a retry completes
+// the line.
+func (tail *Tail) readLine() ([]byte, error) {
+	for {
+		frag, err := tail.readSlice()
+		if err == bufio.ErrBufferFull {
+			tail.partial = append(tail.partial, frag...)
+			if line := tail.cutLongLine(); line != nil {
+				return line, nil
+			}
+			continue
+		}
+
+		line := frag
+		if tail.partial != nil {
+			line = append(tail.partial, frag...)
+			tail.partial = nil
+		}
+		if err == nil && tail.ending == LineEndingCRLF && !bytes.HasSuffix(line, []byte("\r\n")) {
+			// A lone "\n" does not end the line.
+			tail.partial = append([]byte(nil), line...)
+			if line := tail.cutLongLine(); line != nil {
+				return line, nil
+			}
+			continue
+		}
+		switch {
+		case err == io.EOF && len(line) > 0:
+			// The rest of the line is yet to be written.
+			return line, nil
+		case err == io.EOF:
+			return nil, err
+		case err != nil:
+			// ReadSlice's result is only valid until the next read.
+			tail.partial = append([]byte(nil), line...)
+			return nil, err
+		}
+		return line, nil
+	}
+}
+
+// cutLongLine returns the first HardMaxLineBytes of the line read so
+// far, once it holds more, keeping the rest for the next line. It
+// returns nil otherwise.
+func (tail *Tail) cutLongLine() []byte {
+	n := tail.HardMaxLineBytes
+	if n == 0 {
+		n = DefaultHardMaxLineBytes
+	}
+	if n < 0 || len(tail.partial) < n {
+		return nil
+	}
+	line := tail.partial[:n]
+	tail.partial = append([]byte(nil), tail.partial[n:]...)
+	log.Printf("Splitting a line of %s longer than %d bytes", tail.Filename, n)
+	return line
+}
+
+// flushPartial emits the line read so far, which is not to be
+// completed as the tail ends at EOF. Incomplete records are dropped,
+// but for the last line of a hex dump.
+func (tail *Tail) flushPartial() {
+	if tail.RecordSize > 0 || len(tail.partial) == 0 {
+		return
+	}
+	line := tail.partial
+	tail.partial = nil
+	tail.sendLine(line)
+}
+
+// splitLineEnding splits the terminator off line, per LineEnding.
+func (tail *Tail) splitLineEnding(line []byte) ([]byte, []byte) {
+	n := len(line)
+	switch {
+	case len(tail.Delimiters) > 0:
+		if n >= 1 && tail.delims[line[n-1]] {
+			return line[:n-1], line[n-1:]
+		}
+		return line, nil
+	case tail.ending == LineEndingCR:
+		if n >= 1 && line[n-1] == '\r' {
+			return line[:n-1], line[n-1:]
+		}
+		return line, nil
+	case tail.ending == LineEndingCRLF:
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			return line[:n-2], line[n-2:]
+		}
+		return line, nil
+	case n >= 2 && line[n-2] == '\r' && line[n-1] == '\n':
+		return line[:n-2], line[n-2:]
+	case n >= 1 && line[n-1] == '\n':
+		return line[:n-1], line[n-1:]
+	}
+	return line, nil
+}
+
+// readSlice is bufio.Reader.ReadSlice up to the terminator of lines,
+// or any of the Delimiters.
+func (tail *Tail) readSlice() ([]byte, error) {
+	r := tail.reader
+	if len(tail.Delimiters) == 0 {
+		return r.ReadSlice(tail.delimiter())
+	}
+	for scanned := 0; ; {
+		buf, _ := r.Peek(r.Buffered())
+		for i := scanned; i < len(buf); i++ {
+			if tail.delims[buf[i]] {
+				r.Discard(i + 1)
+				return buf[:i+1], nil
+			}
+		}
+		scanned = len(buf)
+		if len(buf) == r.Size() {
+			r.Discard(len(buf))
+			return buf, bufio.ErrBufferFull
+		}
+		if _, err := r.Peek(len(buf) + 1); err != nil {
+			// Nothing more was buffered, but the buffered bytes
+			// may have been moved to make room.
+			buf, _ = r.Peek(r.Buffered())
+			r.Discard(len(buf))
+			return buf, err
+		}
+	}
+}
+
+// delimiter returns the last byte of the terminator of lines.
+func (tail *Tail) delimiter() byte {
+	if tail.ending == LineEndingCR {
+		return '\r'
+	}
+	return '\n'
+}
+
+// retryable reports whether reading should be retried after err.
+func (tail *Tail) retryable(err error) bool {
+	if err == ErrReadTimeout {
+		return true
+	}
+	if tail.RetryableError != nil {
+		return tail.RetryableError(err)
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.EINTR, syscall.EAGAIN, syscall.ESTALE:
+			return true
+		}
+	}
+	return false
+}
+
+func (tail *Tail) tailFileSync() {
+	defer tail.Done()
+	defer tail.close()
+
+	if tail.input == nil && tail.file == nil {
+		// deferred first open.
+		err := tail.reopen()
+		if err != nil {
+			tail.Kill(err)
+			return
+		}
+	} else if tail.file != nil {
+		// Opened by TailFile.
+		tail.reopened(nil)
+	}
+
+	// Seek to requested location on first open of the file. Pipes
+	// cannot seek, and are read from whatever is written next.
+	var pos int64
+	if tail.seekable() {
+		offset, err := tail.startOffset()
+		if err != nil {
+			tail.Kill(&TailError{tail.Filename, "read", err})
+			return
+		}
+		pos, err = tail.file.Seek(offset, 0)
+		if err != nil {
+			tail.Kill(&TailError{tail.Filename, "seek", err})
+			return
+		}
+	}
+
+	tail.resetReader(pos)
+	tail.resetCheckpoint(pos)
+	if pos == 0 {
+		tail.headerLeft = tail.SkipHeaderLines
+	} else {
+		tail.headerLeft = 0
+	}
+	close(tail.started)
+
+	// Read line by line.
+	for {
+		if tail.MaxLag > 0 && tail.seekable() {
+			if err := tail.dropBehind(); err == ErrStop {
+				return
+			} else if err != nil {
+				tail.Kill(&TailError{tail.Filename, "read", err})
+				return
+			}
+		}
+
+		line, err := tail.next()
+		switch err {
+		case nil:
+			if line != nil && !tail.headerLine() {
+				tail.setCaughtUp(false)
+				tail.heartbeat, tail.idleTimer = nil, nil
+				tail.sendLine(line)
+			}
+			if tail.MaxBytes > 0 && tail.bytesRead >= tail.MaxBytes {
+				tail.Kill(ErrMaxBytesReached)
+				return
+			}
+		case io.EOF:
+			tail.setCaughtUp(true)
+			if !tail.Follow || tail.input != nil || tail.finishing.Load() {
+				tail.flushPartial()
+				return
+			}
+			if tail.fifo {
+				// The writer closed the pipe; wait for the next one.
+				if err := tail.reopen(); err != nil {
+					tail.Kill(err)
+					return
+				}
+				tail.resetReader(0)
+				break
+			}
+			// When EOF is reached, wait for more data to become
+			// available. Wait strategy is based on the `tail.watcher`
+			// implementation (inotify or polling).
+			err := tail.waitForChanges()
+			if err != nil {
+				if err != ErrStop {
+					tail.Kill(err)
+				}
+				return
+			}
+		default: // non-EOF error
+			select {
+			case <-tail.Dying():
+				// Stopping, the file or reader possibly closed by
+				// StopWithTimeout to interrupt the read.
+				return
+			default:
+			}
+			if tail.fifo && errors.Is(err, os.ErrDeadlineExceeded) {
+				// Nothing was written to the pipe meanwhile.
+				break
+			}
+			if tail.RetryOnPermissionDenied && tail.seekable() && errors.Is(err, os.ErrPermission) {
+				log.Printf("Reopening %s once permission to read it is restored", tail.Filename)
+				if err := tail.reopenDenied(); err != nil {
+					if err != ErrStop {
+						tail.Kill(err)
+					}
+					return
+				}
+				break
+			}
+			if !tail.retryable(err) {
+				tail.Kill(&TailError{tail.Filename, "read", err})
+				return
+			}
+			log.Printf("Retrying to read %s after error: %s", tail.Filename, err)
+			select {
+			case <-tail.clock.After(readRetryDelay):
+			case <-tail.Dying():
+				return
+			}
+		}
+
+		select {
+		case <-tail.Dying():
+			return
+		case <-tail.resets:
+			if err := tail.rewind(); err != nil {
+				if err != ErrStop {
+					tail.Kill(err)
+				}
+				return
+			}
+		case <-tail.resyncs:
+			if err := tail.resync(); err != nil {
+				if err != ErrStop {
+					tail.Kill(err)
+				}
+				return
+			}
+		case <-tail.batchTimer:
+			tail.flushBatch()
+		case <-tail.repeatTimer:
+			tail.flushRepeated()
+		default:
+		}
+	}
+}
+
+// startOffset returns the offset at which tailing begins, as requested
+// by Resume, NLines, StartTime, StartPercent, StartLine or Location.
+func (tail *Tail) startOffset() (int64, error) {
+	if tail.Resume != nil {
+		return tail.resumeOffset()
+	}
+	if tail.NLines > 0 {
+		return lastLinesOffset(tail.file, tail.NLines, tail.delimiter())
+	}
+
+	fi, err := tail.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := fi.Size()
+	if tail.startSize >= 0 && tail.startSize < size {
+		// Written to once TailFile returned; that is read.
+		size = tail.startSize
+	}
+
+	if !tail.StartTime.IsZero() && tail.TimeParser != nil {
+		return timeOffset(tail.file, size, tail.delimiter(), tail.StartTime, tail.TimeParser)
+	}
+	if tail.StartPercent > 0 {
+		return tail.percentOffset(size)
+	}
+	if tail.StartLine > 0 {
+		return lineOffset(tail.file, size, tail.StartLine, tail.delimiter())
+	}
+
+	var offset int64
+	switch {
+	case tail.Location == LocationEnd:
+		offset = size
+	case tail.Location < 0:
+		offset = -int64(tail.Location) - 1
+	default:
+		offset = size - int64(tail.Location)
+	}
+	if offset < 0 {
+		offset = 0
+	} else if offset > size {
+		offset = size
+	}
+	return offset, nil
+}
+
+// resumeOffset returns the offset of Resume, or 0 if the file is no
+// longer the one it was saved for.
+func (tail *Tail) resumeOffset() (int64, error) {
+	fi, err := tail.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if fi.Size() < tail.Resume.Offset {
+		log.Printf("Tailing %s from its beginning, as it was truncated since saved", tail.Filename)
+		return 0, nil
+	}
+	if len(tail.Resume.Fingerprint) > 0 {
+		sum, err := fingerprint(tail.file, tail.Resume.Offset)
+		if err != nil {
+			return 0, err
+		}
+		if !bytes.Equal(sum, tail.Resume.Fingerprint) {
+			log.Printf("Tailing %s from its beginning, as it was replaced since saved", tail.Filename)
+			return 0, nil
+		}
+	}
+	return tail.Resume.Offset, nil
+}
+
+// percentOffset returns the offset of the first line or record that
+// begins at or after StartPercent of the file size.
+func (tail *Tail) percentOffset(size int64) (int64, error) {
+	from := int64(float64(size) * tail.StartPercent / 100)
+	if from >= size {
+		return size, nil
+	}
+	if n := int64(tail.recordSize()); n > 0 {
+		return min((from+n-1)/n*n, size), nil
+	}
+	start := size
+	err := scanLines(tail.file, size, from, tail.delimiter(), func(offset int64, text string) bool {
+		start = offset
+		return false
+	})
+	return start, err
+}
+
+// dropBehind skips ahead when more than MaxLag bytes of the file are
+// left unread, to the first line or record starting within the last
+// MaxLag bytes, and emits a marker for the skipped bytes.
+func (tail *Tail) dropBehind() error {
+	fi, err := tail.file.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	offset := tail.tell() - int64(len(tail.partial))
+	if size-offset <= tail.MaxLag {
+		return nil
+	}
+
+	start := size - tail.MaxLag
+	if size := int64(tail.recordSize()); size > 0 {
+		records := (start - offset + size - 1) / size
+		start = offset + records*size
+	} else {
+		from := start
+		start = size
+		err = scanLines(tail.file, size, from, tail.delimiter(), func(offset int64, text string) bool {
+			start = offset
+			return false
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := tail.settleRead(); err != nil {
+		return err
+	}
+	if _, err := tail.file.Seek(start, 0); err != nil {
+		return err
+	}
+	tail.resetReader(start)
+	tail.emit(&Line{Dropped: start - offset, Time: tail.clock.Now()})
+	return nil
+}
+
+// rewind seeks the file back to its beginning and discards any
+// buffered data.
+func (tail *Tail) rewind() error {
+	if !tail.seekable() {
+		return nil
+	}
+	if err := tail.settleRead(); err == ErrStop {
+		return err
+	} else if err != nil {
+		return &TailError{tail.Filename, "seek", err}
+	}
+	if _, err := tail.file.Seek(0, 0); err != nil {
+		return &TailError{tail.Filename, "seek", err}
+	}
+	tail.resetReader(0)
+	tail.resetCheckpoint(0)
+	return nil
+}
+
+// resync has reading continue from the current offset of the file,
+// per Resync.
+func (tail *Tail) resync() error {
+	if !tail.seekable() {
+		return nil
+	}
+	if err := tail.settleRead(); err == ErrStop {
+		return err
+	} else if err != nil {
+		return &TailError{tail.Filename, "seek", err}
+	}
+	offset, err := tail.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return &TailError{tail.Filename, "seek", err}
+	}
+	tail.resetReader(offset)
+	tail.resetCheckpoint(offset)
+	return nil
+}
+
+// seekable reports whether the source of the tail is a regular file,
+// rather than a pipe or reader.
+func (tail *Tail) seekable() bool {
+	return tail.input == nil && !tail.fifo
+}
+
+// tell returns the offset of the next byte to be read from the file.
+func (tail *Tail) tell() int64 {
+	return tail.src.offset - int64(tail.reader.Buffered())
+}
+
+// markEOF records the read offset along with the bytes preceding it.
+func (tail *Tail) markEOF() error {
+	offset := tail.tell()
+	n := int64(truncationCheckSize)
+	if offset < n {
+		n = offset
+	}
+	buf := make([]byte, n)
+	if _, err := tail.file.ReadAt(buf, offset-n); err == io.EOF {
+		// Truncated already, which truncated reports by the size.
+		buf = nil
+	} else if err != nil {
+		return err
+	}
+	tail.eofOffset, tail.eofBytes = offset, buf
+	return nil
+}
+
+// truncated reports whether the file was truncated since markEOF was
+// called. Besides the file having shrunk below the read offset, this
+// detects a file that was truncated and rewritten beyond the read
+// offset in between two checks of the watcher, as the content
+// preceding the read offset will have changed.
+func (tail *Tail) truncated() (bool, error) {
+	fi, err := tail.file.Stat()
+	if err != nil {
+		return false, err
+	}
+	if fi.Size() < tail.eofOffset {
+		return true, nil
+	}
+	buf := make([]byte, len(tail.eofBytes))
+	if _, err := tail.file.ReadAt(buf, tail.eofOffset-int64(len(buf))); err != nil {
+		return false, err
+	}
+	return !bytes.Equal(buf, tail.eofBytes), nil
+}
+
+// waitForChanges waits until the file has been appended, deleted,
+// moved or truncated. When moved or deleted - the file will be
+// reopened if ReOpen is true. Truncated files are always reopened.
+func (tail *Tail) waitForChanges() error {
+	if err := tail.markEOF(); err != nil {
+		return err
+	}
+	if tail.renamed {
+		return tail.waitForDescriptorChanges()
+	}
+	if tail.changes == nil {
+		st, err := tail.file.Stat()
+		if err != nil {
+			return err
+		}
+		if err := tail.watchChanges(st); err != nil {
+			return err
+		}
+
+		// Data appended after EOF was reached, but before the watcher
+		// was registered, is reported by no event; read it first.
+		if st, err = tail.file.Stat(); err != nil {
+			return err
+		}
+		if st.Size() > tail.eofOffset {
+			return nil
+		}
+	}
+
+	select {
+	case <-tail.changes.Modified:
+		truncated, err := tail.truncated()
+		if err != nil {
+			return err
+		}
+		if truncated {
+			log.Printf("Re-seeking truncated file %s ...", tail.Filename)
+			tail.sendEvent(EventTruncated)
+			return tail.rewind()
+		}
+		return tail.backOffEmptyWakeups()
+	case <-tail.changes.Deleted:
+		tail.stopChanges()
+		return tail.handleRemoved(EventFileDeleted)
+	case <-tail.changes.Renamed:
+		tail.stopChanges()
+		if tail.FollowSymlinks {
+			// The link may have been repointed before the watcher
+			// was registered, which it reports as a rename.
+			retargeted, err := tail.retargeted()
+			if err != nil {
+				return err
+			}
+			if retargeted {
+				return tail.followRetargeted()
+			}
+		}
+		if tail.FollowMode == FollowByDescriptor {
+			tail.sendEvent(EventRotated)
+			tail.renamed = true
+			return nil
+		}
+		return tail.handleRemoved(EventRotated)
+	case <-tail.changes.Truncated:
+		// With copytruncate, the truncation may be reported while
+		// the file still holds the data written before it, which is
+		// then read first.
+		truncated, err := tail.truncated()
+		if err != nil {
+			return err
+		}
+		if !truncated {
+			return nil
+		}
+
+		// The file was truncated in place, as a replaced file is
+		// reported as renamed or deleted instead: it is read again
+		// from its beginning through the same descriptor and
+		// watcher.
+		log.Printf("Re-seeking truncated file %s ...", tail.Filename)
+		tail.sendEvent(EventTruncated)
+		return tail.rewind()
+	case <-tail.batchTimer:
+		tail.flushBatch()
+		return nil
+	case <-tail.repeatTimer:
+		tail.flushRepeated()
+		return nil
+	case <-tail.idleHeartbeat():
+		tail.sendHeartbeat()
+		return nil
+	case <-tail.healthCheck():
+		fi, err := tail.file.Stat()
+		if err != nil {
+			return err
+		}
+		if fi.Size() > tail.eofOffset {
+			log.Printf("Reading %s, of which the watcher missed changes", tail.Filename)
+		}
+		return nil
+	case <-tail.symlinkCheck():
+		retargeted, err := tail.retargeted()
+		if err != nil || !retargeted {
+			return err
+		}
+		tail.stopChanges()
+		return tail.followRetargeted()
+	case <-tail.resets:
+		return tail.rewind()
+	case <-tail.resyncs:
+		return tail.resync()
+	case <-tail.finish:
+		return nil
+	case <-tail.release:
+		return tail.waitReleased()
+	case <-tail.idleRelease():
+		tail.idleTimer = nil
+		log.Printf("Closing %s while idle", tail.Filename)
+		return tail.waitReleased()
+	case <-tail.Dying():
+		return ErrStop
+	}
+}
+
+// idleRelease returns a channel on which the file is to be released,
+// when ReleaseFDWhenIdle is set. It fires ReleaseFDWhenIdle after the
+// tail began waiting at EOF past the last line, or since reopening.
+func (tail *Tail) idleRelease() <-chan time.Time {
+	if tail.ReleaseFDWhenIdle <= 0 {
+		return nil
+	}
+	if tail.idleTimer == nil {
+		tail.idleTimer = tail.clock.After(tail.ReleaseFDWhenIdle)
+	}
+	return tail.idleTimer
+}
+
+// releaseFile asks for the file to be closed the next time the tail
+// waits for changes, for MultiTail to keep within MaxOpenFiles.
+func (tail *Tail) releaseFile() {
+	select {
+	case tail.release <- true:
+	default:
+	}
+}
+
+// holdsFile reports whether the file is open and not about to be
+// released. It is safe to call while the tail is running.
+func (tail *Tail) holdsFile() bool {
+	tail.mu.Lock()
+	defer tail.mu.Unlock()
+	return tail.file != nil && len(tail.release) == 0
+}
+
+// waitReleased closes the file until the watcher, which keeps running,
+// reports a change. The file is then opened again by name and read on
+// from the offset it was left at, unless it was replaced meanwhile, in
+// which case the new file is read from its beginning.
+func (tail *Tail) waitReleased() error {
+	if !tail.ReOpen || !tail.seekable() {
+		return nil
+	}
+	fi, err := tail.file.Stat()
+	if err != nil {
+		return err
+	}
+	offset := tail.tell()
+	tail.flushRepeated()
+	tail.flushBatch()
+	tail.closeFile()
+
+	ended, err := tail.waitChange()
+	if err != nil {
+		return err
+	}
+
+	err = tail.open()
+	if os.IsNotExist(err) {
+		// The file is gone, and whatever was left unread with it.
+		tail.stopChanges()
+		return tail.handleRemoved(EventFileDeleted)
+	} else if err != nil {
+		return &TailError{tail.Filename, "open", err}
+	}
+	cur, err := tail.file.Stat()
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(fi, cur) {
+		tail.replacedWhileClosed(fi)
+		return nil
+	}
+	if ended {
+		tail.stopChanges()
+	}
+
+	truncated, err := tail.truncated()
+	if err != nil {
+		return err
+	}
+	if truncated {
+		log.Printf("Re-seeking truncated file %s ...", tail.Filename)
+		tail.sendEvent(EventTruncated)
+		return tail.rewind()
+	}
+	if _, err := tail.file.Seek(offset, io.SeekStart); err != nil {
+		return &TailError{tail.Filename, "seek", err}
+	}
+	tail.resetReader(offset)
+	return nil
+}
+
+// waitChange waits for the watcher to report a change, delivering
+// heartbeats meanwhile, and tells whether it reports no further ones.
+func (tail *Tail) waitChange() (ended bool, err error) {
+	for {
+		select {
+		case <-tail.changes.Modified:
+			return false, nil
+		case <-tail.changes.Truncated:
+			return false, nil
+		case <-tail.changes.Deleted:
+			return true, nil
+		case <-tail.changes.Renamed:
+			return true, nil
+		case <-tail.finish:
+			return false, nil
+		case <-tail.idleHeartbeat():
+			tail.sendHeartbeat()
+		case <-tail.Dying():
+			return false, ErrStop
+		}
+	}
+}
+
+// replacedWhileClosed reads the file opened anew from its beginning,
+// as it replaced old, the file previously open, while it was closed.
+func (tail *Tail) replacedWhileClosed(old os.FileInfo) {
+	tail.stopChanges()
+	tail.sendEvent(EventRotated)
+	log.Printf("Re-opened %s, which was replaced while closed", tail.Filename)
+	tail.resetReader(0)
+	tail.resetCheckpoint(0)
+	tail.skipReopenedHeader()
+	tail.reopened(old)
+	tail.sendEvent(EventReopened)
+}
+
+// reopenDenied closes the file, which could no longer be read for lack
+// of permission, and opens it again once permission is restored, per
+// RetryOnPermissionDenied, to read on from where reading failed.
+func (tail *Tail) reopenDenied() error {
+	old := tail.opened
+	offset := tail.tell() - int64(len(tail.partial))
+	tail.flushRepeated()
+	tail.flushBatch()
+	tail.closeFile()
+	for {
+		select {
+		case <-tail.clock.After(tail.getPollInterval()):
+		case <-tail.Dying():
+			return ErrStop
+		}
+		err := tail.open()
+		if errors.Is(err, os.ErrPermission) {
+			continue
+		} else if os.IsNotExist(err) {
+			tail.stopChanges()
+			return tail.handleRemoved(EventFileDeleted)
+		} else if err != nil {
+			return &TailError{tail.Filename, "open", err}
+		}
+		break
+	}
+	if !os.SameFile(old, tail.opened) {
+		tail.replacedWhileClosed(old)
+		return nil
+	}
+	if _, err := tail.file.Seek(offset, io.SeekStart); err != nil {
+		return &TailError{tail.Filename, "seek", err}
+	}
+	tail.resetReader(offset)
+	return nil
+}
+
+// backOffEmptyWakeups waits before the file is read again when it was
+// reported modified in a row without any data to read since, for the
+// read loop not to spin.
+func (tail *Tail) backOffEmptyWakeups() error {
+	if tail.eofOffset != tail.wakeupOffset {
+		tail.wakeupOffset, tail.emptyWakeups = tail.eofOffset, 0
+		return nil
+	}
+	tail.emptyWakeups++
+	delay := emptyWakeupBackoff
+	for i := 1; i < tail.emptyWakeups && delay < maxEmptyWakeupBackoff; i++ {
+		delay *= 2
+	}
+	select {
+	case <-tail.clock.After(min(delay, maxEmptyWakeupBackoff)):
+		return nil
+	case <-tail.Dying():
+		return ErrStop
+	}
+}
+
+// healthCheck returns a channel on which to check the file for unread
+// data, when HealthCheckInterval is set.
+func (tail *Tail) healthCheck() <-chan time.Time {
+	if tail.HealthCheckInterval <= 0 {
+		return nil
+	}
+	return tail.clock.After(tail.HealthCheckInterval)
+}
+
+// idleHeartbeat returns a channel on which a heartbeat is due, when
+// HeartbeatInterval is set. It fires HeartbeatInterval after the tail
+// began waiting at EOF past the last line or heartbeat.
+func (tail *Tail) idleHeartbeat() <-chan time.Time {
+	if tail.HeartbeatInterval <= 0 || tail.Events == nil {
+		return nil
+	}
+	if tail.heartbeat == nil {
+		tail.heartbeat = tail.clock.After(tail.HeartbeatInterval)
+	}
+	return tail.heartbeat
+}
+
+// sendHeartbeat delivers EventHeartbeat, and has the next one be due
+// HeartbeatInterval later.
+func (tail *Tail) sendHeartbeat() {
+	tail.heartbeat = nil
+	tail.sendEvent(EventHeartbeat)
+}
+
+// symlinkCheck returns a channel on which to check whether the path
+// was repointed to another file, when FollowSymlinks is set. Watchers
+// report no change on the file itself when this happens.
+func (tail *Tail) symlinkCheck() <-chan time.Time {
+	if !tail.FollowSymlinks {
+		return nil
+	}
+	return tail.clock.After(tail.getPollInterval())
+}
+
+// followRetargeted reopens the file once the path, a symlink, points
+// to another file.
+func (tail *Tail) followRetargeted() error {
+	tail.drain()
+	tail.sendEvent(EventRotated)
+	log.Printf("Re-opening %s as it now points to another file ...", tail.Filename)
+	if err := tail.reopen(); err != nil {
+		return err
+	}
+	tail.resetReader(0)
+	tail.sendEvent(EventReopened)
+	return nil
+}
+
+// retargeted reports whether the path now resolves to another file
+// than the one open. A missing file is left to the watcher to report.
+func (tail *Tail) retargeted() (bool, error) {
+	fi, err := os.Stat(tail.Filename)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	cur, err := tail.file.Stat()
+	if err != nil {
+		return false, err
+	}
+	return !os.SameFile(fi, cur), nil
+}
+
+// waitForDescriptorChanges waits until the file, which was renamed
+// while following by descriptor, has been appended or truncated. As
+// watchers track files by name, the open file itself is polled.
+func (tail *Tail) waitForDescriptorChanges() error {
+	for {
+		select {
+		case <-tail.clock.After(tail.getPollInterval()):
+		case <-tail.batchTimer:
+			tail.flushBatch()
+		case <-tail.repeatTimer:
+			tail.flushRepeated()
+		case <-tail.idleHeartbeat():
+			tail.sendHeartbeat()
+		case <-tail.resets:
+			return tail.rewind()
+		case <-tail.resyncs:
+			return tail.resync()
+		case <-tail.finish:
+			return nil
+		case <-tail.Dying():
+			return ErrStop
+		}
+
+		fi, err := tail.file.Stat()
+		if err != nil {
+			return err
+		}
+		switch {
+		case fi.Size() > tail.eofOffset:
+			return nil
+		case fi.Size() < tail.eofOffset:
+			tail.sendEvent(EventTruncated)
+			return tail.rewind()
+		}
+	}
+}
+
+// stopChanges stops the watcher goroutine reporting changes to the
+// current file, so that it does not outlive the file being reopened.
+func (tail *Tail) stopChanges() {
+	if tail.changes != nil {
+		tail.changes.Stop()
+		tail.changes = nil
+	}
+}
+
+// handleRemoved reads the rest of the file after it was deleted or
+// moved away, then reopens it if ReOpen is true, and stops the tail
+// otherwise.
+func (tail *Tail) handleRemoved(event EventType) error {
+	tail.drain()
+	lost := tail.unreadBytes()
+	if lost > 0 {
+		log.Printf("%d bytes of %s were left unread", lost, tail.Filename)
+		tail.mu.Lock()
+		tail.lost += lost
+		tail.mu.Unlock()
+	}
+	tail.deliverEvent(Event{Type: event, Time: tail.clock.Now(), Lost: lost})
+	if tail.ReOpen {
+		// XXX: we must not log from a library.
+		log.Printf("Re-opening moved/deleted file %s ...", tail.Filename)
+		if err := tail.reopen(); err != nil {
+			return err
+		}
+		log.Printf("Successfully reopened %s", tail.Filename)
+		tail.resetReader(0)
+		tail.sendEvent(EventReopened)
+		return nil
+	}
+	log.Printf("Stopping tail as file no longer exists: %s", tail.Filename)
+	return ErrStop
+}
+
+// unreadBytes returns the number of bytes of the open file past the
+// read offset. As the file is still open once moved or deleted, its
+// size is that it had at the time.
+func (tail *Tail) unreadBytes() int64 {
+	if tail.file == nil {
+		// Released by waitReleased; what was left is unknown.
+		return 0
+	}
+	fi, err := tail.file.Stat()
+	if err != nil {
+		return 0
+	}
+	if n := fi.Size() - tail.tell(); n > 0 {
+		return n
+	}
+	return 0
+}
+
+// sendEvent delivers an event on the Events channel, if enabled.
+func (tail *Tail) sendEvent(typ EventType) {
+	tail.deliverEvent(Event{Type: typ, Time: tail.clock.Now()})
+}
+
+// deliverEvent is sendEvent for events with more than a type.
+func (tail *Tail) deliverEvent(event Event) {
+	if tail.Events == nil {
+		return
+	}
+	select {
+	case tail.Events <- event:
+	case <-tail.Dying():
+	}
+}
+
+// sendError delivers an error on the Errors channel.
+func (tail *Tail) sendError(err error) {
+	select {
+	case tail.Errors <- err:
+	case <-tail.Dying():
 	}
-	panic("unreachable")
 }
 
 // sendLine sends the line(s) to Lines channel, splitting longer lines
 // if necessary.
 func (tail *Tail) sendLine(line []byte) {
-	now := time.Now()
+	now := tail.clock.Now()
+	if tail.RecordSize > 0 {
+		tail.emit(&Line{Bytes: line, Time: now})
+		return
+	}
+	if tail.hexdump {
+		offset := tail.tell() - int64(len(line))
+		tail.emit(&Line{Text: hexdumpLine(offset, line), Time: now})
+		return
+	}
+
+	// The terminator, if kept, only ends the last of split lines.
+	line, ending := tail.splitLineEnding(line)
+
+	// Lines are whole by now, so escape sequences cannot be cut in
+	// two. They are stripped before splitting for the same reason.
+	if tail.StripANSI {
+		line = ansiEscape.ReplaceAll(line, nil)
+	}
+	if tail.TrimSpace {
+		line = bytes.TrimSpace(line)
+	}
+	if tail.SkipEmptyLines && len(line) == 0 {
+		return
+	}
+
+	if tail.LineParser != nil {
+		parsed, err := tail.LineParser(line)
+		if err != nil {
+			tail.sendError(&TailError{tail.Filename, "parse", err})
+			return
+		}
+		if parsed.Time.IsZero() {
+			parsed.Time = now
+		}
+		parsed.Delimiter = tail.delimiterOf(ending)
+		tail.emit(parsed)
+		return
+	}
+
+	if tail.Raw {
+		tail.sendRaw(line, ending, now)
+		return
+	}
+
 	lines := []string{string(line)}
 
 	// Split longer lins
-	if tail.MaxLineSize > 0 && len(line) > tail.MaxLineSize {
+	maxLineSize := tail.getMaxLineSize()
+	if maxLineSize > 0 && len(line) > maxLineSize {
 		lines = partitionString(
-			string(line), tail.MaxLineSize)
+			string(line), maxLineSize)
+	}
+
+	// Sub-lines of a split line share the timestamp of the first.
+	if tail.TimeParser != nil {
+		if t, ok := tail.TimeParser(lines[0]); ok {
+			now = t
+		}
+	}
+
+	if tail.KeepLineEnding {
+		lines[len(lines)-1] += string(ending)
+	}
+
+	last := len(lines) - 1
+	for _, line := range lines[:last] {
+		tail.emit(&Line{Text: line, Time: now})
+	}
+	tail.emit(&Line{Text: lines[last], Time: now, Delimiter: tail.delimiterOf(ending)})
+}
+
+// delimiterOf returns the byte of Delimiters the ending of a line is
+// made of, if any, or else 0.
+func (tail *Tail) delimiterOf(ending []byte) byte {
+	if len(tail.Delimiters) == 0 || len(ending) == 0 {
+		return 0
+	}
+	return ending[0]
+}
+
+// sendRaw sends the line as `Line.Raw`, per Config.Raw, split as
+// sendLine does.
+func (tail *Tail) sendRaw(line, ending []byte, now time.Time) {
+	maxLineSize := tail.getMaxLineSize()
+	if tail.TimeParser != nil {
+		first := line
+		if maxLineSize > 0 && len(first) > maxLineSize {
+			first = first[:maxLineSize]
+		}
+		if t, ok := tail.TimeParser(string(first)); ok {
+			now = t
+		}
+	}
+
+	delimiter := tail.delimiterOf(ending)
+	if !tail.KeepLineEnding {
+		ending = nil
+	}
+	raw, size := tail.rawCopy(line, ending), len(line)
+	for maxLineSize > 0 && size > maxLineSize {
+		tail.emit(&Line{Raw: raw[:maxLineSize:maxLineSize], Time: now})
+		raw, size = raw[maxLineSize:], size-maxLineSize
+	}
+	tail.emit(&Line{Raw: raw, Time: now, Delimiter: delimiter})
+}
+
+// rawCopy returns a copy of the line followed by the ending, out of
+// rawBlock unless the line is long.
+func (tail *Tail) rawCopy(line, ending []byte) []byte {
+	n := len(line) + len(ending)
+	if n > rawBlockSize/4 {
+		return append(append(make([]byte, 0, n), line...), ending...)
+	}
+	if tail.rawBlock == nil || cap(tail.rawBlock)-len(tail.rawBlock) < n {
+		tail.rawBlock = make([]byte, 0, rawBlockSize)
+	}
+	start := len(tail.rawBlock)
+	tail.rawBlock = append(append(tail.rawBlock, line...), ending...)
+	return tail.rawBlock[start:len(tail.rawBlock):len(tail.rawBlock)]
+}
+
+// emit sends a line to the Lines channel, once RateLimit allows it,
+// or holds it back per CollapseRepeats. The line is dropped if the
+// tail is stopped meanwhile, so that Stop does not hang when the
+// consumer no longer reads.
+func (tail *Tail) emit(line *Line) {
+	line.Filename = tail.Filename
+	line.Offset = tail.tell() - int64(len(tail.partial))
+	if !tail.CollapseRepeats || line.Dropped > 0 {
+		tail.send(line)
+		return
+	}
+	if prev := tail.repeated; prev != nil && prev.Text == line.Text &&
+		bytes.Equal(prev.Bytes, line.Bytes) && bytes.Equal(prev.Raw, line.Raw) &&
+		prev.Stream == line.Stream && prev.Delimiter == line.Delimiter {
+		prev.Repeat++
+		prev.Offset = line.Offset
+		return
+	}
+	tail.flushRepeated()
+	line.Repeat = 1
+	tail.repeated = line
+	tail.repeatTimer = tail.clock.After(repeatTimeout)
+}
+
+// flushRepeated sends the line held back per CollapseRepeats, if any.
+func (tail *Tail) flushRepeated() {
+	if tail.repeated == nil {
+		return
+	}
+	line := tail.repeated
+	tail.repeated, tail.repeatTimer = nil, nil
+	tail.send(line)
+}
+
+// send numbers a line and delivers it.
+func (tail *Tail) send(line *Line) {
+	line.Num = tail.numLines
+	tail.numLines++
+	tail.throttle()
+	if tail.OnLine != nil {
+		tail.OnLine(line)
+	}
+	if tail.ReplayBuffer > 0 {
+		tail.remember(line)
+	}
+	if tail.Batches != nil {
+		tail.batchLine(line)
+		return
+	}
+	select {
+	case tail.routeOf(line) <- line:
+	case <-tail.Dying():
+	}
+}
+
+// routeOf returns the channel on which to send a line, according to
+// Routes.
+func (tail *Tail) routeOf(line *Line) chan *Line {
+	if tail.Routed == nil {
+		return tail.Lines
+	}
+	data := line.Bytes
+	if data == nil {
+		data = line.Raw
+	}
+	if data == nil {
+		data = []byte(line.Text)
+	}
+	var route string
+	if tail.RouteFunc != nil {
+		route = tail.RouteFunc(data)
+	} else {
+		for _, prefix := range tail.Routes {
+			if bytes.HasPrefix(data, []byte(prefix)) {
+				route = prefix
+				break
+			}
+		}
+	}
+	if ch, ok := tail.Routed[route]; ok {
+		return ch
+	}
+	return tail.Lines
+}
+
+// batchLine adds a line to the pending batch, which is sent once it
+// holds Batch lines or BatchTimeout after its first line.
+func (tail *Tail) batchLine(line *Line) {
+	if tail.batch == nil {
+		tail.batchTimer = tail.clock.After(tail.BatchTimeout)
+	}
+	tail.batch = append(tail.batch, line)
+	if len(tail.batch) >= tail.Batch {
+		tail.flushBatch()
+	}
+}
+
+// flushBatch sends the pending batch, if any.
+func (tail *Tail) flushBatch() {
+	if tail.batch == nil {
+		return
+	}
+	select {
+	case tail.Batches <- tail.batch:
+	case <-tail.Dying():
+	}
+	tail.batch, tail.batchTimer = nil, nil
+}
+
+// throttle waits until the next line may be emitted according to
+// RateLimit. As the read loop is blocked meanwhile, reading from the
+// file is paced as well.
+func (tail *Tail) throttle() {
+	rate := tail.getRateLimit()
+	if rate <= 0 {
+		return
+	}
+	interval := time.Duration(float64(time.Second) / rate)
+	now := tail.clock.Now()
+	if tail.nextEmit.After(now) {
+		select {
+		case <-tail.clock.After(tail.nextEmit.Sub(now)):
+		case <-tail.Dying():
+		}
+	} else {
+		tail.nextEmit = now
+	}
+	tail.nextEmit = tail.nextEmit.Add(interval)
+}
+
+// lastLinesBlockSize is the size of the blocks read backward from the
+// end of the file when looking for the last lines.
+const lastLinesBlockSize = 4096
+
+// lineOffset returns the offset at which line n of the file, ended by
+// delim and counted from 1, starts, reading the file forward in blocks
+// up to size. This is size when the file has fewer lines.
+func lineOffset(f io.ReaderAt, size int64, n int, delim byte) (int64, error) {
+	buf := make([]byte, lastLinesBlockSize)
+	var offset int64
+	for n > 1 && offset < size {
+		chunk := buf[:min(int64(len(buf)), size-offset)]
+		if _, err := f.ReadAt(chunk, offset); err != nil {
+			return 0, err
+		}
+		for i := 0; i < len(chunk); i++ {
+			if chunk[i] != delim {
+				continue
+			}
+			n--
+			if n == 1 {
+				return offset + int64(i) + 1, nil
+			}
+		}
+		offset += int64(len(chunk))
+	}
+	return offset, nil
+}
+
+// lastLinesOffset returns the offset at which the last n lines of the
+// file, ended by delim, start, reading the file backward in blocks
+// from its end. The whole file is covered when it has fewer than n
+// lines, and none of it when n is zero.
+func lastLinesOffset(f seekableFile, n int, delim byte) (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	end := fi.Size()
+	if n <= 0 {
+		return end, nil
+	}
+	buf := make([]byte, lastLinesBlockSize)
+
+	// A trailing newline terminates the last line rather than
+	// beginning another one.
+	if end > 0 {
+		if _, err := f.ReadAt(buf[:1], end-1); err != nil {
+			return 0, err
+		}
+		if buf[0] == delim {
+			end--
+		}
+	}
+
+	for end > 0 {
+		start := end - int64(len(buf))
+		if start < 0 {
+			start = 0
+		}
+		chunk := buf[:end-start]
+		if _, err := f.ReadAt(chunk, start); err != nil {
+			return 0, err
+		}
+		for i := len(chunk) - 1; i >= 0; i-- {
+			if chunk[i] != delim {
+				continue
+			}
+			n--
+			if n == 0 {
+				return start + int64(i) + 1, nil
+			}
+		}
+		end = start
+	}
+	return 0, nil
+}
+
+// timeOffset returns the offset of the first line of the file logged
+// at or after t, according to parse, or the size of the file if there
+// is none. The file is binary searched, assuming that timestamps only
+// increase through it; should the lines probed meanwhile turn out to
+// be out of order, the file is scanned linearly instead.
+func timeOffset(f io.ReaderAt, size int64, delim byte, t time.Time, parse func(string) (time.Time, bool)) (int64, error) {
+	type probe struct {
+		offset int64
+		time   time.Time
+	}
+	var probes []probe
+	first := func(from int64) (before bool, err error) {
+		// No timestamped line left counts as logged after t.
+		err = scanLines(f, size, from, delim, func(offset int64, text string) bool {
+			ts, ok := parse(text)
+			if ok {
+				probes = append(probes, probe{offset, ts})
+				before = ts.Before(t)
+			}
+			return !ok
+		})
+		return before, err
+	}
+
+	// The beginning of the file is always probed, for out of order
+	// timestamps to be noticed in more cases.
+	if _, err := first(0); err != nil {
+		return 0, err
+	}
+
+	// Find the smallest offset x such that the first timestamped line
+	// starting at or after x was logged at or after t.
+	lo, hi := int64(0), size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		before, err := first(mid)
+		if err != nil {
+			return 0, err
+		}
+		if before {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+
+	sort.Slice(probes, func(i, j int) bool { return probes[i].offset < probes[j].offset })
+	for i := 1; i < len(probes); i++ {
+		if probes[i].time.Before(probes[i-1].time) {
+			return linearTimeOffset(f, size, delim, t, parse)
+		}
 	}
 
-	for _, line := range lines {
-		tail.Lines <- &Line{line, now}
+	offset := size
+	err := scanLines(f, size, lo, delim, func(start int64, text string) bool {
+		offset = start
+		return false
+	})
+	return offset, err
+}
+
+// linearTimeOffset is the counterpart of timeOffset for files whose
+// timestamps are out of order, returning the offset of the first line
+// logged at or after t.
+func linearTimeOffset(f io.ReaderAt, size int64, delim byte, t time.Time, parse func(string) (time.Time, bool)) (int64, error) {
+	offset := size
+	err := scanLines(f, size, 0, delim, func(start int64, text string) bool {
+		if ts, ok := parse(text); ok && !ts.Before(t) {
+			offset = start
+			return false
+		}
+		return true
+	})
+	return offset, err
+}
+
+// scanLines calls fn with the offset and text of each line of the file,
+// ended by delim, starting at or after from, until fn returns false.
+func scanLines(f io.ReaderAt, size, from int64, delim byte, fn func(offset int64, text string) bool) error {
+	offset := from
+	if from > 0 {
+		// Start from the byte preceding from to tell whether a line
+		// begins right at from.
+		offset = from - 1
+	}
+	r := bufio.NewReader(io.NewSectionReader(f, offset, size-offset))
+	if from > 0 {
+		skipped, err := r.ReadSlice(delim)
+		for err == bufio.ErrBufferFull {
+			offset += int64(len(skipped))
+			skipped, err = r.ReadSlice(delim)
+		}
+		offset += int64(len(skipped))
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
 	}
+	for {
+		line, err := r.ReadString(delim)
+		if len(line) > 0 {
+			text := strings.TrimRight(line, "\r\n")
+			if !fn(offset, text) {
+				return nil
+			}
+			offset += int64(len(line))
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
 
+// hexdumpLine formats up to 16 bytes found at offset as a line of
+// `hexdump -C`.
+func hexdumpLine(offset int64, data []byte) string {
+	dump := strings.TrimSuffix(hex.Dump(data), "\n")
+	return fmt.Sprintf("%08x", offset) + dump[8:]
 }
 
 // partitionString partitions the string into chunks of given size,
-// with the last chunk of variable size.
+// with the last chunk of variable size. A chunkSize of zero or less
+// leaves the string whole.
 func partitionString(s string, chunkSize int) []string {
 	if chunkSize <= 0 {
-		panic("invalid chunkSize")
+		return []string{s}
 	}
 	length := len(s)
 	chunks := 1 + length/chunkSize
@@ -6,11 +6,24 @@
 package tail
 
 import (
-	"./watch"
-	_ "fmt"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ActiveState/tail/watch"
+	"gopkg.in/tomb.v1"
+	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"testing/fstest"
 	"time"
 )
 
@@ -20,175 +33,3480 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
+
+	// Use a smaller poll duration for faster test runs. Keep it below
+	// 100ms (which value is used as common delays for tests). It is
+	// set once, as tails of earlier tests may still be reading it.
+	watch.POLL_DURATION = 5 * time.Millisecond
+}
+
+func TestMustExist(t *testing.T) {
+	tail, err := TailFile("/no/such/file", Config{Follow: true, MustExist: true})
+	if err == nil {
+		t.Error("MustExist:true is violated")
+		tail.Stop()
+	}
+	tail, err = TailFile("/no/such/file", Config{Follow: true, MustExist: false})
+	if err != nil {
+		t.Error("MustExist:false is violated")
+	}
+	tail.Stop()
+	tail, err = TailFile("README.md", Config{Follow: true, MustExist: true})
+	if err != nil {
+		t.Error("MustExist:true on an existing file is violated")
+	}
+	tail.Stop()
+}
+
+func TestValidateConfig(_t *testing.T) {
+	t := NewTailTest("validate-config", _t)
+	t.CreateFile("test.txt", "hello\n")
+	t.CreateFile("unreadable.txt", "hello\n")
+	if err := os.Chmod(t.path+"/unreadable.txt", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(t.path+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	parse := func(text string) (time.Time, bool) { return time.Time{}, false }
+
+	for _, test := range []struct {
+		name     string
+		filename string
+		config   Config
+	}{
+		{"ReOpen without Follow", "test.txt", Config{ReOpen: true}},
+		{"invalid FollowMode", "test.txt", Config{FollowMode: FollowByName + 1}},
+		{"negative MaxLineSize", "test.txt", Config{MaxLineSize: -1}},
+		{"negative NLines", "test.txt", Config{NLines: -1}},
+		{"negative RecordSize", "test.txt", Config{RecordSize: -1}},
+		{"negative ReaderBufferSize", "test.txt", Config{ReaderBufferSize: -1}},
+		{"Location and NLines", "test.txt", Config{Location: -1, NLines: 2}},
+		{"Location and StartTime", "test.txt", Config{Location: -1, StartTime: time.Now(), TimeParser: parse}},
+		{"StartTime without TimeParser", "test.txt", Config{StartTime: time.Now()}},
+		{"FS without Poll", "test.txt", Config{FS: fstest.MapFS{}}},
+		{"missing file", "missing.txt", Config{MustExist: true}},
+		{"directory", "dir", Config{MustExist: true}},
+		{"unreadable file", "unreadable.txt", Config{MustExist: true}},
+	} {
+		filename := t.path + "/" + test.filename
+		if test.name == "unreadable file" && os.Geteuid() == 0 {
+			// Permissions do not apply to root.
+			continue
+		}
+		if err := ValidateConfig(filename, test.config); err == nil {
+			t.Errorf("%s: expected ValidateConfig to fail", test.name)
+		}
+		if tail, err := TailFile(filename, test.config); err == nil {
+			t.Errorf("%s: expected TailFile to fail", test.name)
+			tail.Stop()
+		}
+	}
+
+	// FollowMode implies Follow, and a missing file is fine unless it
+	// must exist.
+	for _, config := range []Config{
+		{FollowMode: FollowByName},
+		{Follow: true, ReOpen: true, MustExist: true},
+		{NLines: 2, MustExist: true},
+	} {
+		if err := ValidateConfig(t.path+"/test.txt", config); err != nil {
+			t.Errorf("unexpected error for %+v: %s", config, err)
+		}
+	}
+	if err := ValidateConfig(t.path+"/missing.txt", Config{Follow: true}); err != nil {
+		t.Errorf("unexpected error for a missing file: %s", err)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	for _, test := range []struct {
+		config   Config
+		expected error
+	}{
+		{Config{ReOpen: true}, ErrReOpenRequiresFollow},
+		{Config{Follow: true, MaxLineSize: -1}, ErrInvalidMaxLineSize},
+	} {
+		tail, err := TailFile("/no/such/file", test.config)
+		if !errors.Is(err, test.expected) {
+			t.Errorf("expected %q, got %v", test.expected, err)
+		}
+		if tail != nil {
+			t.Errorf("expected no tail along with %q", test.expected)
+			tail.Stop()
+		}
+	}
+
+	if parts := partitionString("hello", 0); len(parts) != 1 || parts[0] != "hello" {
+		t.Errorf("unexpected partition of a line with no size limit: %q", parts)
+	}
+}
+
+func TestMaxLineSize(_t *testing.T) {
+	t := NewTailTest("maxlinesize", _t)
+	t.CreateFile("test.txt", "hello\nworld\nfin\nhe")
+	tail := t.StartTail("test.txt", Config{Follow: true, Location: -1, MaxLineSize: 3})
+	t.VerifyTailOutputAsync(tail, []string{"hel", "lo", "wor", "ld", "fin", "he"})
+
+	// Delete after a reasonable delay, to give tail sufficient time
+	// to read all lines.
+	<-time.After(100 * time.Millisecond)
+	t.RemoveFile("test.txt")
+	tail.Stop()
+}
+
+func TestLongLine(_t *testing.T) {
+	t := NewTailTest("longline", _t)
+	long := strings.Repeat("x", 16*1024)
+	t.CreateFile("test.txt", long+"\nshort\n")
+	tail := t.StartTail("test.txt", Config{Follow: false, Location: -1, MaxLineSize: 0})
+	t.VerifyTailOutput(tail, []string{long, "short"})
+}
+
+func TestHardMaxLineBytes(_t *testing.T) {
+	t := NewTailTest("hard-max-line-bytes", _t)
+	const size, hardMax = 50 << 20, 1 << 20
+	t.CreateFile("test.txt", strings.Repeat("x", size)+"\nshort\n")
+	defer t.RemoveFile("test.txt")
+	runtime.GC() // Of the line written
+	tail := t.StartTail("test.txt", Config{Location: -1, HardMaxLineBytes: hardMax})
+
+	// The line comes in pieces of hardMax bytes, without it ever being
+	// held in memory whole.
+	var total int
+	var stats runtime.MemStats
+	for line := range tail.Lines {
+		if line.Text == "short" {
+			break
+		}
+		if len(line.Text) > hardMax {
+			t.Fatalf("line of %d bytes exceeds the hard limit", len(line.Text))
+		}
+		total += len(line.Text)
+		runtime.ReadMemStats(&stats)
+		if stats.HeapInuse > size/2 {
+			t.Fatalf("%d bytes of heap in use while reading the line", stats.HeapInuse)
+		}
+	}
+	if total != size {
+		t.Fatalf("read %d bytes of the line; expected %d", total, size)
+	}
+	if err := tail.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNext(_t *testing.T) {
+	t := NewTailTest("next", _t)
+	t.CreateFile("test.txt", "hello\nworld\nfin\n")
+	tail := t.StartTail("test.txt", Config{Follow: false, Location: -1})
+
+	ctx := context.Background()
+	for _, expected := range []string{"hello", "world", "fin"} {
+		line, err := tail.Next(ctx)
+		if err != nil {
+			t.Fatalf("Next returned error: %v", err)
+		}
+		if line.Text != expected {
+			t.Fatalf("mismatch; %s (actual) != %s (expected)", line.Text, expected)
+		}
+	}
+	if _, err := tail.Next(ctx); err != io.EOF {
+		t.Fatalf("expected io.EOF at end of tail; got %v", err)
+	}
+}
+
+func TestReset(_t *testing.T) {
+	t := NewTailTest("reset", _t)
+	t.CreateFile("test.txt", "hello\nworld\n")
+	tail := t.StartTail("test.txt", Config{Follow: true, Location: -1})
+	t.ReadLines(tail, []string{"hello", "world"})
+
+	tail.Reset()
+	t.ReadLines(tail, []string{"hello", "world"})
+
+	// Follow mode must survive the reset.
+	t.AppendFile("test.txt", "more\n")
+	t.ReadLines(tail, []string{"more"})
+	tail.Stop()
+}
+
+func TestResync(_t *testing.T) {
+	t := NewTailTest("resync", _t)
+	t.CreateFile("test.txt", "one\ntwo\nthree\nfour\nfive\n")
+	tail := t.StartTail("test.txt", Config{Follow: true, Location: -1})
+	t.ReadLines(tail, []string{"one"})
+
+	// The rest of the file was read ahead, and is discarded past the
+	// line being sent.
+	if _, err := tail.file.Seek(14, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	tail.Resync()
+	t.ReadLines(tail, []string{"two", "four", "five"})
+
+	// An offset behind has lines read again, and following goes on.
+	if _, err := tail.file.Seek(4, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	tail.Resync()
+	t.ReadLines(tail, []string{"two", "three", "four", "five"})
+	t.AppendFile("test.txt", "six\n")
+	t.ReadLines(tail, []string{"six"})
+	t.VerifyPosition(tail, 28)
+	tail.Stop()
+	t.RemoveFile("test.txt")
+}
+
+func TestNLines(_t *testing.T) {
+	t := NewTailTest("nlines", _t)
+	t.CreateFile("test.txt", "one\ntwo\nthree\nfour\nfive\n")
+	tail := t.StartTail("test.txt", Config{Follow: false, NLines: 2})
+	t.VerifyTailOutput(tail, []string{"four", "five"})
+}
+
+func TestLastLinesOffset(_t *testing.T) {
+	t := NewTailTest("last-lines-offset", _t)
+	long := strings.Repeat("x", 2*lastLinesBlockSize)
+	for _, test := range []struct {
+		content  string
+		n        int
+		expected int64
+	}{
+		{"", 3, 0},
+		{"a\nb\nc\n", 0, 6},
+		{"a\nb\nc\n", 2, 2},
+		{"a\nb\nc\n", 3, 0},
+		{"a\nb\nc\n", 4, 0},
+		{"a\nb\nc", 1, 4},
+		{"a\nb\nc", 3, 0},
+		{"\n\n\n", 1, 2},
+		{long + "\ny\n", 1, int64(len(long)) + 1},
+		{long + "\ny\n", 2, 0},
+		{"y\n" + long + "\n", 1, 2},
+	} {
+		t.CreateFile("test.txt", test.content)
+		f, err := os.Open(t.path + "/test.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset, err := lastLinesOffset(f, test.n, '\n')
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offset != test.expected {
+			t.Errorf("last %d lines of %.20q: offset %d (actual) != %d (expected)",
+				test.n, test.content, offset, test.expected)
+		}
+	}
+}
+
+// BenchmarkLastLines finds the last lines of a large file, reading no
+// more than the blocks holding them: memory use per operation is that
+// of a single block, whatever the size of the file.
+func BenchmarkLastLines(b *testing.B) {
+	os.MkdirAll(".test", 0700)
+	filename := ".test/benchmark-last-lines.txt"
+	content := bytes.Repeat([]byte("a line of benchmark data\n"), 4<<20)
+	if err := ioutil.WriteFile(filename, content, 0600); err != nil {
+		b.Fatal(err)
+	}
+	defer os.Remove(filename)
+	f, err := os.Open(filename)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := lastLinesOffset(f, 100, '\n'); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestNoTrailingNewline(_t *testing.T) {
+	t := NewTailTest("no-trailing-newline", _t)
+	t.CreateFile("test.txt", "a\nb\nc")
+	tail := t.StartTail("test.txt", Config{Follow: false, Location: -1})
+	t.VerifyTailOutput(tail, []string{"a", "b", "c"})
+
+	// The same goes for a line longer than the read buffer.
+	long := strings.Repeat("x", 100)
+	t.CreateFile("long.txt", "a\n"+long)
+	tail = t.StartTail("long.txt", Config{Follow: false, Location: -1, ReaderBufferSize: 16})
+	t.VerifyTailOutput(tail, []string{"a", long})
+}
+
+func TestClockLineTime(_t *testing.T) {
+	t := NewTailTest("clock-line-time", _t)
+	clock := newFakeClock()
+	clock.Advance(time.Hour)
+	t.CreateFile("test.txt", "hello\nworld\n")
+	tail := t.StartTail("test.txt", Config{Follow: true, Location: -1, ReportEvents: true, Clock: clock})
+	defer tail.Stop()
+	for i := 0; i < 2; i++ {
+		if line := <-tail.Lines; !line.Time.Equal(clock.Now()) {
+			t.Fatalf("line %q stamped %v, not %v", line.Text, line.Time, clock.Now())
+		}
+	}
+	t.TruncateFile("test.txt", "")
+	event := t.VerifyEvent(tail, EventTruncated)
+	if !event.Time.Equal(clock.Now()) {
+		t.Fatalf("event stamped %v, not %v", event.Time, clock.Now())
+	}
+	t.RemoveFile("test.txt")
+}
+
+func TestCollapseRepeats(_t *testing.T) {
+	t := NewTailTest("collapse-repeats", _t)
+	clock := newFakeClock()
+	t.CreateFile("test.txt", strings.Repeat("same\n", 5)+"other\n")
+	tail := t.StartTail("test.txt", Config{Follow: true, Location: -1, CollapseRepeats: true, Clock: clock})
+	line := <-tail.Lines
+	if line.Text != "same" || line.Repeat != 5 || line.Offset != 25 {
+		t.Fatalf("unexpected line %q repeated %d times up to %d", line.Text, line.Repeat, line.Offset)
+	}
+
+	// The last line is held back until it is known not to repeat.
+	select {
+	case line := <-tail.Lines:
+		t.Fatalf("unexpected line %q before the timeout", line.Text)
+	case <-time.After(50 * time.Millisecond):
+	}
+	clock.BlockUntil(1)
+	clock.Advance(repeatTimeout)
+	line = <-tail.Lines
+	if line.Text != "other" || line.Repeat != 1 || line.Num != 1 {
+		t.Fatalf("unexpected line %q repeated %d times, numbered %d", line.Text, line.Repeat, line.Num)
+	}
+	tail.Stop()
+}
+
+func TestReadAllLines(_t *testing.T) {
+	t := NewTailTest("read-all-lines", _t)
+	t.CreateFile("test.txt", "hello\nworld\nlonger line\n")
+
+	lines, err := ReadAllLines(t.path+"/test.txt", Config{Location: -7, MaxLineSize: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var texts []string
+	for _, line := range lines {
+		texts = append(texts, line.Text)
+	}
+	expected := []string{"world", "longe", "r lin", "e"}
+	if fmt.Sprint(texts) != fmt.Sprint(expected) {
+		t.Fatalf("mismatch; %q (actual) != %q (expected)", texts, expected)
+	}
+
+	if _, err := ReadAllLines(t.path+"/missing.txt", Config{}); !os.IsNotExist(err) {
+		t.Fatalf("expected a missing file error, got %v", err)
+	}
+}
+
+func TestBinaryBehavior(_t *testing.T) {
+	t := NewTailTest("binary-behavior", _t)
+	t.CreateFile("text.txt", "hello\n\tworld\x1b[0m\n")
+	t.CreateFile("binary.bin", "ELF\x00\x01\x02\x03hello world\n\xff\xfe")
+
+	// Text files are read as usual.
+	for _, behavior := range []BinaryBehavior{BinaryRefuse, BinaryHexdump} {
+		tail := t.StartTail("text.txt", Config{Location: -1, BinaryBehavior: behavior})
+		t.VerifyTailOutput(tail, []string{"hello", "\tworld\x1b[0m"})
+	}
+
+	// Binary files fail to open, whether they must exist or not.
+	if err := ValidateConfig(t.path+"/binary.bin", Config{MustExist: true, BinaryBehavior: BinaryRefuse}); !errors.Is(err, ErrBinaryFile) {
+		t.Fatalf("expected ErrBinaryFile from ValidateConfig, got %v", err)
+	}
+	_, err := TailFile(t.path+"/binary.bin", Config{Location: -1, MustExist: true, BinaryBehavior: BinaryRefuse})
+	if !errors.Is(err, ErrBinaryFile) {
+		t.Fatalf("expected ErrBinaryFile, got %v", err)
+	}
+	tail := t.StartTail("binary.bin", Config{Location: -1, BinaryBehavior: BinaryRefuse})
+	for range tail.Lines {
+	}
+	if err := tail.Err(); !errors.Is(err, ErrBinaryFile) {
+		t.Fatalf("expected ErrBinaryFile, got %v", err)
+	}
+
+	// Or they are dumped, up to their end.
+	tail = t.StartTail("binary.bin", Config{Location: -1, BinaryBehavior: BinaryHexdump})
+	t.VerifyTailOutput(tail, []string{
+		"00000000  45 4c 46 00 01 02 03 68  65 6c 6c 6f 20 77 6f 72  |ELF....hello wor|",
+		"00000010  6c 64 0a ff fe                                    |ld...|",
+	})
+}
+
+func TestRecordSize(_t *testing.T) {
+	t := NewTailTest("recordsize", _t)
+	records := [][]byte{
+		bytes.Repeat([]byte{1}, 64),
+		bytes.Repeat([]byte{2}, 64),
+		bytes.Repeat([]byte{3}, 32),
+	}
+	t.CreateFile("test.bin", string(bytes.Join(records, nil)))
+	tail := t.StartTail("test.bin", Config{Follow: false, Location: -1, RecordSize: 64})
+
+	// Only the complete records are emitted.
+	for _, record := range records[:2] {
+		line, ok := <-tail.Lines
+		if !ok {
+			t.Fatalf("tail ended early")
+		}
+		if !bytes.Equal(line.Bytes, record) {
+			t.Fatalf("mismatch; %v (actual) != %v (expected)", line.Bytes, record)
+		}
+	}
+	t.VerifyTailOutput(tail, nil)
+}
+
+// staleReader cuts its first read short, then fails once with ESTALE
+// as an NFS-backed file may.
+type staleReader struct {
+	r     io.Reader
+	reads int
+}
+
+func (r *staleReader) Read(p []byte) (int, error) {
+	r.reads++
+	switch r.reads {
+	case 1:
+		return r.r.Read(p[:3])
+	case 2:
+		return 0, &os.PathError{Op: "read", Path: "test.txt", Err: syscall.ESTALE}
+	}
+	return r.r.Read(p)
+}
+
+func TestRetryReadError(_t *testing.T) {
+	t := NewTailTest("retry-read-error", _t)
+	t.CreateFile("test.txt", "hello\nworld\n")
+
+	newFileReader = func(file io.Reader) io.Reader { return &staleReader{r: file} }
+	defer func() { newFileReader = func(file io.Reader) io.Reader { return file } }()
+
+	tail := t.StartTail("test.txt", Config{Follow: false, Location: -1})
+	t.VerifyTailOutput(tail, []string{"hello", "world"})
+}
+
+// slowReader holds reads back until release is closed, as reads of a
+// stalled network file system do.
+type slowReader struct {
+	r       io.Reader
+	release chan struct{}
+}
+
+func (r slowReader) Read(p []byte) (int, error) {
+	<-r.release
+	return r.r.Read(p)
+}
+
+func TestReadTimeout(_t *testing.T) {
+	t := NewTailTest("read-timeout", _t)
+	t.CreateFile("test.txt", "hello\nworld\n")
+	defer func() { newFileReader = func(file io.Reader) io.Reader { return file } }()
+
+	// The data of reads that timed out is not lost.
+	release := make(chan struct{})
+	newFileReader = func(file io.Reader) io.Reader { return slowReader{file, release} }
+	tail := t.StartTail("test.txt", Config{Follow: true, Location: -1, ReadTimeout: 10 * time.Millisecond})
+	<-time.After(50 * time.Millisecond)
+	close(release)
+	t.ReadLines(tail, []string{"hello", "world"})
+	tail.Stop()
+
+	// A read that timed out, to end once the file is seeked, neither
+	// moves the offset of the file nor has its data taken for that at
+	// the new offset.
+	release = make(chan struct{})
+	tail = t.StartTail("test.txt", Config{Follow: true, Location: -1, ReadTimeout: 10 * time.Millisecond})
+	<-time.After(50 * time.Millisecond)
+	if _, err := tail.file.Seek(6, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	tail.Resync()
+	<-time.After(50 * time.Millisecond)
+	close(release)
+	t.ReadLines(tail, []string{"world"})
+	tail.Stop()
+
+	// A read that hangs does not hold Stop up.
+	hung := make(chan struct{})
+	defer close(hung)
+	newFileReader = func(file io.Reader) io.Reader { return slowReader{file, hung} }
+	tail = t.StartTail("test.txt", Config{Follow: true, Location: -1, ReadTimeout: 10 * time.Millisecond})
+	<-time.After(50 * time.Millisecond)
+	start := time.Now()
+	tail.Stop()
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("stopping took %s despite ReadTimeout", elapsed)
+	}
+}
+
+// deniedReader fails reading as if permission was revoked, while
+// denied is set, or always if it is nil.
+type deniedReader struct {
+	r      io.Reader
+	denied *atomic.Bool
+}
+
+func (r deniedReader) Read(p []byte) (int, error) {
+	if r.denied == nil || r.denied.Load() {
+		return 0, &os.PathError{Op: "read", Path: "test.txt", Err: syscall.EACCES}
+	}
+	return r.r.Read(p)
+}
+
+func TestTailError(_t *testing.T) {
+	t := NewTailTest("tail-error", _t)
+	t.CreateFile("test.txt", "hello\n")
+
+	newFileReader = func(file io.Reader) io.Reader { return deniedReader{} }
+	defer func() { newFileReader = func(file io.Reader) io.Reader { return file } }()
+
+	tail := t.StartTail("test.txt", Config{Follow: true, Location: -1})
+	for range tail.Lines {
+	}
+	err := tail.Err()
+	if !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("expected a permission error, got %v", err)
+	}
+	var tailErr *TailError
+	if !errors.As(err, &tailErr) || tailErr.Op != "read" || tailErr.Filename != t.path+"/test.txt" {
+		t.Fatalf("expected a TailError reading test.txt, got %#v", err)
+	}
+
+	// Permissions do not apply to root.
+	if os.Geteuid() == 0 {
+		return
+	}
+	if err := os.Chmod(t.path+"/test.txt", 0); err != nil {
+		t.Fatal(err)
+	}
+	tail = t.StartTail("test.txt", Config{Follow: true, Location: -1})
+	for range tail.Lines {
+	}
+	if err := tail.Err(); !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("expected a permission error opening the file, got %v", err)
+	}
+}
+
+func TestRetryOnPermissionDenied(_t *testing.T) {
+	t := NewTailTest("retry-on-permission-denied", _t)
+	t.CreateFile("test.txt", "hello\n")
+	var denied atomic.Bool
+	newFileReader = func(file io.Reader) io.Reader { return deniedReader{file, &denied} }
+	defer func() { newFileReader = func(file io.Reader) io.Reader { return file } }()
+
+	tail := t.StartTail("test.txt", Config{Follow: true, Location: -1, RetryOnPermissionDenied: true})
+	t.ReadLines(tail, []string{"hello"})
+
+	// Reading is denied for a while, then restored.
+	denied.Store(true)
+	t.AppendFile("test.txt", "world\n")
+	<-time.After(50 * time.Millisecond)
+	denied.Store(false)
+	t.ReadLines(tail, []string{"world"})
+	tail.Stop()
+
+	// Permissions do not apply to root.
+	if os.Geteuid() == 0 {
+		return
+	}
+	tail = t.StartTail("test.txt", Config{Follow: true, ReOpen: true, Location: -1, RetryOnPermissionDenied: true})
+	t.ReadLines(tail, []string{"hello", "world"})
+	// The file is replaced by one that cannot be read for a while.
+	t.CreateFile("test.txt.new", "again\n")
+	if err := os.Chmod(t.path+"/test.txt.new", 0); err != nil {
+		t.Fatal(err)
+	}
+	t.RenameFile("test.txt.new", "test.txt")
+	<-time.After(50 * time.Millisecond)
+	if err := os.Chmod(t.path+"/test.txt", 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.ReadLines(tail, []string{"again"})
+	tail.Stop()
+}
+
+func TestMaxBytes(_t *testing.T) {
+	t := NewTailTest("maxbytes", _t)
+	t.CreateFile("test.txt", strings.Repeat("abc\n", 25))
+	tail := t.StartTail("test.txt", Config{Follow: true, Location: -1, MaxBytes: 10})
+
+	// The third line reaches the cap and is emitted in full.
+	t.ReadLines(tail, []string{"abc", "abc", "abc"})
+	if line, ok := <-tail.Lines; ok {
+		t.Fatalf("more lines than expected: %q", line.Text)
+	}
+	if err := tail.Wait(); err != ErrMaxBytesReached {
+		t.Fatalf("expected ErrMaxBytesReached, got %v", err)
+	}
+}
+
+func TestTimeParser(_t *testing.T) {
+	t := NewTailTest("timeparser", _t)
+	t.CreateFile("test.txt", "Jan  2 15:04:05 host app: started\nno timestamp\n")
+	parse := func(text string) (time.Time, bool) {
+		if len(text) < len(time.Stamp) {
+			return time.Time{}, false
+		}
+		ts, err := time.Parse(time.Stamp, text[:len(time.Stamp)])
+		return ts, err == nil
+	}
+	tail := t.StartTail("test.txt", Config{Follow: false, Location: -1, TimeParser: parse})
+
+	line := <-tail.Lines
+	if expected := time.Date(0, time.January, 2, 15, 4, 5, 0, time.UTC); !line.Time.Equal(expected) {
+		t.Fatalf("mismatch; %v (actual) != %v (expected)", line.Time, expected)
+	}
+	line = <-tail.Lines
+	if time.Since(line.Time) > time.Minute {
+		t.Fatalf("expected the read time for an unparsed line, got %v", line.Time)
+	}
+	t.VerifyTailOutput(tail, nil)
+}
+
+func TestStopWithoutReader(_t *testing.T) {
+	t := NewTailTest("stop-without-reader", _t)
+	t.CreateFile("test.txt", "hello\nworld\n")
+	tail := t.StartTail("test.txt", Config{Follow: true, Location: -1})
+
+	// Read one line, leaving the tail blocked on sending the next.
+	t.ReadLines(tail, []string{"hello"})
+	<-time.After(100 * time.Millisecond)
+
+	done := make(chan error)
+	go func() { done <- tail.Stop() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Stop returned error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for Stop")
+	}
+}
+
+func TestRunning(_t *testing.T) {
+	t := NewTailTest("running", _t)
+	t.CreateFile("test.txt", "hello\n")
+	tail := t.StartTail("test.txt", Config{Follow: true, Location: -1})
+	t.ReadLines(tail, []string{"hello"})
+	if !tail.Running() {
+		t.Fatal("tail not running while tailing")
+	}
+	select {
+	case <-tail.Dead():
+		t.Fatal("tail dead while tailing")
+	default:
+	}
+
+	tail.Stop()
+	if tail.Running() {
+		t.Fatal("tail still running once stopped")
+	}
+	<-tail.Dead()
+
+	// A tail that ended on its own is no longer running either.
+	tail = t.StartTail("test.txt", Config{Follow: false, Location: -1})
+	t.VerifyTailOutput(tail, []string{"hello"})
+	<-tail.Dead()
+	if tail.Running() {
+		t.Fatal("tail still running once ended")
+	}
+}
+
+func TestStopWithTimeout(_t *testing.T) {
+	t := NewTailTest("stop-with-timeout", _t)
+	t.CreateFile("test.txt", "hello\nworld\n")
+	tail := t.StartTail("test.txt", Config{Follow: true, Location: -1})
+
+	// Lines are left unread.
+	<-tail.Started()
+	start := time.Now()
+	if err := tail.StopWithTimeout(time.Second); err != nil {
+		t.Fatalf("StopWithTimeout returned error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("StopWithTimeout took %s", elapsed)
+	}
+
+	// A pending Read of a reader blocks the tail from ending.
+	r, w := io.Pipe()
+	defer w.Close()
+	tail, err := TailReader(r, Config{Follow: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-tail.Started()
+	start = time.Now()
+	if err := tail.StopWithTimeout(100 * time.Millisecond); err != ErrStopTimeout {
+		t.Fatalf("expected ErrStopTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("StopWithTimeout took %s", elapsed)
+	}
+
+	// The reader, once closed, no longer blocks it.
+	done := make(chan error, 1)
+	go func() { done <- tail.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("tail ended with error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("tail still blocked reading once stopped")
+	}
+	if _, err := w.Write([]byte("hello\n")); err != io.ErrClosedPipe {
+		t.Fatalf("expected the pipe closed, got %v", err)
+	}
+}
+
+func TestFIFO(_t *testing.T) {
+	t := NewTailTest("fifo", _t)
+	// Any FIFO left by a previous run is made anew.
+	t.RemoveDir()
+	t.CreateDir()
+	if err := syscall.Mkfifo(t.path+"/test.fifo", 0600); err != nil {
+		t.Fatal(err)
+	}
+	tail := t.StartTail("test.fifo", Config{Follow: true, Location: -1})
+	go func() {
+		// Each burst comes from a separate writer.
+		for _, burst := range []string{"hello\nworld\n", "fifo\n", "again\n"} {
+			f, err := os.OpenFile(t.path+"/test.fifo", os.O_WRONLY, 0)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			f.WriteString(burst)
+			f.Close()
+			<-time.After(100 * time.Millisecond)
+		}
+	}()
+	t.ReadLines(tail, []string{"hello", "world", "fifo", "again"})
+
+	// Stopping must not hang while waiting for the next writer.
+	done := make(chan error)
+	go func() { done <- tail.Stop() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Stop returned error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for Stop")
+	}
+}
+
+func TestCaughtUp(_t *testing.T) {
+	t := NewTailTest("caughtup", _t)
+	t.CreateFile("test.txt", strings.Repeat("backlog\n", 10))
+	tail := t.StartTail("test.txt", Config{Follow: true, Location: -1})
+
+	for i := 0; i < 10; i++ {
+		if tail.CaughtUp() {
+			t.Fatalf("caught up with %d backlog lines left", 10-i)
+		}
+		t.ReadLines(tail, []string{"backlog"})
+	}
+	waitCaughtUp := func(expected bool) {
+		for deadline := time.Now().Add(time.Second); tail.CaughtUp() != expected; {
+			if time.Now().After(deadline) {
+				t.Fatalf("timeout waiting for CaughtUp() to be %v", expected)
+			}
+			<-time.After(10 * time.Millisecond)
+		}
+	}
+	waitCaughtUp(true)
+
+	// A new line is pending until it is read.
+	t.AppendFile("test.txt", "live\n")
+	waitCaughtUp(false)
+	t.ReadLines(tail, []string{"live"})
+	waitCaughtUp(true)
+	tail.Stop()
+}
+
+func TestPosition(_t *testing.T) {
+	t := NewTailTest("position", _t)
+	t.CreateFile("test.txt", strings.Repeat("123456789\n", 10))
+	tail := t.StartTail("test.txt", Config{Follow: true, Location: 0})
+	select {
+	case <-tail.Started():
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for tail to start")
+	}
+	t.VerifyPosition(tail, 100)
+
+	t.AppendFile("test.txt", "more\n")
+	t.ReadLines(tail, []string{"more"})
+	t.VerifyPosition(tail, 105)
+	tail.Stop()
+}
+
+func TestCheckpoint(_t *testing.T) {
+	t := NewTailTest("checkpoint", _t)
+	t.CreateFile("test.txt", "one\ntwo\nthree\nfour\nfive\n")
+	tail := t.StartTail("test.txt", Config{Follow: true, Location: -1})
+	<-tail.Started()
+	if cp := tail.Checkpoint(); cp != 0 {
+		t.Fatalf("expected checkpoint at the start, got %d", cp)
+	}
+
+	var lines []*Line
+	for i := 0; i < 5; i++ {
+		lines = append(lines, <-tail.Lines)
+	}
+
+	// Only the third line is acknowledged, then an earlier one.
+	tail.Commit(lines[2].Offset)
+	tail.Commit(lines[0].Offset)
+	if cp := tail.Checkpoint(); cp != lines[2].Offset || cp != 14 {
+		t.Fatalf("expected checkpoint past the third line at 14, got %d", cp)
+	}
+	tail.Stop()
+}
+
+func TestResume(_t *testing.T) {
+	t := NewTailTest("resume", _t)
+	t.CreateFile("test.txt", "one\ntwo\nthree\n")
+	tail := t.StartTail("test.txt", Config{Follow: true, Location: -1})
+	line := <-tail.Lines
+	tail.Commit(line.Offset)
+	info, err := tail.ResumeInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tail.Stop()
+	if info.Offset != 4 {
+		t.Fatalf("expected to resume past the first line at 4, got %d", info.Offset)
+	}
+
+	// The file grew since; it is resumed from the offset.
+	t.AppendFile("test.txt", "four\n")
+	tail = t.StartTail("test.txt", Config{Resume: &info})
+	t.VerifyTailOutput(tail, []string{"two", "three", "four"})
+
+	// It was replaced by another file, as long.
+	t.CreateFile("test.txt", "ONE\nTWO\nTHREE\nFOUR\n")
+	tail = t.StartTail("test.txt", Config{Resume: &info})
+	t.VerifyTailOutput(tail, []string{"ONE", "TWO", "THREE", "FOUR"})
+
+	// It was truncated below the offset since.
+	t.CreateFile("test.txt", "1\n")
+	tail = t.StartTail("test.txt", Config{Resume: &ResumeInfo{Offset: info.Offset}})
+	t.VerifyTailOutput(tail, []string{"1"})
+}
+
+func TestRateLimit(_t *testing.T) {
+	t := NewTailTest("ratelimit", _t)
+	t.CreateFile("test.txt", strings.Repeat("line\n", 100))
+	start := time.Now()
+	tail := t.StartTail("test.txt", Config{Follow: false, Location: -1, RateLimit: 50})
+	lines := make([]string, 100)
+	for i := range lines {
+		lines[i] = "line"
+	}
+	t.VerifyTailOutput(tail, lines)
+
+	// 100 lines at 50 lines per second take about 2 seconds.
+	elapsed := time.Since(start)
+	if elapsed < 1800*time.Millisecond || elapsed > 3*time.Second {
+		t.Fatalf("emitting 100 lines at 50/sec took %s", elapsed)
+	}
+}
+
+func TestSetRateLimit(_t *testing.T) {
+	t := NewTailTest("setratelimit", _t)
+	t.CreateFile("test.txt", strings.Repeat("line\n", 20))
+	tail := t.StartTail("test.txt", Config{Follow: false, Location: -1, RateLimit: 1000})
+	lines := make([]string, 10)
+	for i := range lines {
+		lines[i] = "line"
+	}
+
+	start := time.Now()
+	t.ReadLines(tail, lines)
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Fatalf("emitting 10 lines at 1000/sec took %s", elapsed)
+	}
+
+	// 10 lines at 25 lines per second take about 400ms.
+	tail.SetRateLimit(25)
+	start = time.Now()
+	t.VerifyTailOutput(tail, lines)
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("emitting 10 lines once lowered to 25/sec took %s", elapsed)
+	}
+}
+
+// TestTuneWhileTailing changes the configuration of a running tail
+// from another goroutine, for `go test -race` to check that doing so
+// is safe.
+func TestTuneWhileTailing(_t *testing.T) {
+	t := NewTailTest("tune-while-tailing", _t)
+	t.CreateFile("test.txt", "")
+	tail := t.StartTail("test.txt", Config{Follow: true, Poll: true, Location: -1})
+
+	done := make(chan struct{})
+	tuned := make(chan struct{})
+	go func() {
+		defer close(tuned)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			tail.SetRateLimit(float64(1000000 * (i % 2)))
+			tail.SetMaxLineSize(100 * (i % 2))
+			tail.SetPollInterval(time.Duration(1+i%5) * time.Millisecond)
+			tail.Position()
+			tail.FileInfo()
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+
+	var lines []string
+	for i := 0; i < 50; i++ {
+		text := fmt.Sprintf("line %d", i)
+		lines = append(lines, text)
+		t.AppendFile("test.txt", text+"\n")
+	}
+	t.ReadLines(tail, lines)
+	close(done)
+	<-tuned
+	tail.Stop()
+}
+
+func TestReplayBuffer(_t *testing.T) {
+	t := NewTailTest("replay-buffer", _t)
+	var content strings.Builder
+	var expected []string
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&content, "line %d\n", i)
+		expected = append(expected, fmt.Sprintf("line %d", i))
+	}
+	t.CreateFile("test.txt", "")
+	tail := t.StartTail("test.txt", Config{Follow: true, Location: -1, ReplayBuffer: 5})
+	defer tail.Stop()
+	if recent := tail.Recent(); len(recent) != 0 {
+		t.Fatalf("%d recent lines before any was emitted", len(recent))
+	}
+
+	// Recent is called while lines are emitted.
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				if recent := tail.Recent(); len(recent) > 5 {
+					t.Errorf("%d recent lines retained", len(recent))
+				}
+			}
+		}
+	}()
+	t.AppendFile("test.txt", content.String())
+	t.ReadLines(tail, expected)
+	close(done)
+
+	var recent []string
+	for _, line := range tail.Recent() {
+		recent = append(recent, line.Text)
+	}
+	if fmt.Sprint(recent) != fmt.Sprint(expected[15:]) {
+		t.Fatalf("recent lines %q instead of %q", recent, expected[15:])
+	}
+	t.RemoveFile("test.txt")
+}
+
+func TestOnLine(_t *testing.T) {
+	t := NewTailTest("on-line", _t)
+	t.CreateFile("test.txt", "hello\nworld\nagain\n")
+	var seen []string
+	onLine := func(line *Line) {
+		seen = append(seen, fmt.Sprintf("%d %s", line.Num, line.Text))
+	}
+	tail := t.StartTail("test.txt", Config{Follow: false, Location: -1, OnLine: onLine})
+	t.VerifyTailOutput(tail, []string{"hello", "world", "again"})
+	expected := []string{"0 hello", "1 world", "2 again"}
+	if fmt.Sprint(seen) != fmt.Sprint(expected) {
+		t.Fatalf("mismatch; %q (actual) != %q (expected)", seen, expected)
+	}
+}
+
+func TestOnReopen(_t *testing.T) {
+	t := NewTailTest("on-reopen", _t)
+	t.CreateFile("test.txt", "hello\n")
+	type reopen struct{ old, new os.FileInfo }
+	reopens := make(chan reopen, 2)
+	onReopen := func(old, new os.FileInfo) {
+		reopens <- reopen{old, new}
+	}
+	tail := t.StartTail("test.txt", Config{Follow: true, ReOpen: true, Location: -1, OnReopen: onReopen})
+	t.ReadLines(tail, []string{"hello"})
+	first, err := os.Stat(t.path + "/test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := <-reopens; r.old != nil || !os.SameFile(r.new, first) {
+		t.Fatalf("expected the first open of the file, got %v, %v", r.old, r.new)
+	}
+
+	t.RenameFile("test.txt", "test.txt.1")
+	t.CreateFile("test.txt", "world\n")
+	t.ReadLines(tail, []string{"world"})
+	second, err := os.Stat(t.path + "/test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := <-reopens
+	if !os.SameFile(r.old, first) || !os.SameFile(r.new, second) || os.SameFile(r.old, r.new) {
+		t.Fatalf("expected a reopen from inode %v to %v", first.Sys(), second.Sys())
+	}
+	tail.Stop()
+	t.RemoveFile("test.txt")
+	t.RemoveFile("test.txt.1")
+}
+
+func TestRoutes(_t *testing.T) {
+	t := NewTailTest("routes", _t)
+	t.CreateFile("test.txt", "[db] connected\n[http] GET /\nstarting\n[http] GET /favicon.ico\n[db] query\n")
+	tail := t.StartTail("test.txt", Config{Follow: false, Location: -1, Routes: []string{"[db]", "[http]"}})
+
+	routed := make(map[string][]string)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	read := func(route string, ch chan *Line) {
+		defer wg.Done()
+		for line := range ch {
+			mu.Lock()
+			routed[route] = append(routed[route], line.Text)
+			mu.Unlock()
+		}
+	}
+	wg.Add(3)
+	go read("", tail.Lines)
+	for route, ch := range tail.Routed {
+		go read(route, ch)
+	}
+	wg.Wait()
+
+	expected := map[string][]string{
+		"[db]":   {"[db] connected", "[db] query"},
+		"[http]": {"[http] GET /", "[http] GET /favicon.ico"},
+		"":       {"starting"},
+	}
+	if fmt.Sprint(routed) != fmt.Sprint(expected) {
+		t.Fatalf("mismatch; %v (actual) != %v (expected)", routed, expected)
+	}
+}
+
+func TestBatch(_t *testing.T) {
+	t := NewTailTest("batch", _t)
+	t.CreateFile("test.txt", "a\nb\nc\nd\ne\n")
+	tail := t.StartTail("test.txt", Config{Follow: true, Location: -1, Batch: 2, BatchTimeout: 50 * time.Millisecond})
+
+	// The last, incomplete batch is sent once its timeout expires.
+	for _, expected := range [][]string{{"a", "b"}, {"c", "d"}, {"e"}} {
+		var batch []*Line
+		select {
+		case batch = <-tail.Batches:
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for batch %v", expected)
+		}
+		var texts []string
+		for _, line := range batch {
+			texts = append(texts, line.Text)
+		}
+		if fmt.Sprint(texts) != fmt.Sprint(expected) {
+			t.Fatalf("mismatch; %v (actual) != %v (expected)", texts, expected)
+		}
+	}
+	tail.Stop()
+}
+
+func benchmarkTail(b *testing.B, config Config, consume func(*Tail) int) {
+	os.MkdirAll(".test", 0700)
+	filename := ".test/benchmark.txt"
+	content := bytes.Repeat([]byte("a line of benchmark data\n"), b.N)
+	if err := ioutil.WriteFile(filename, content, 0600); err != nil {
+		b.Fatal(err)
+	}
+	defer os.Remove(filename)
+
+	b.SetBytes(int64(len(content) / b.N))
+	b.ResetTimer()
+	config.Location = -1
+	tail, err := TailFile(filename, config)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if n := consume(tail); n != b.N {
+		b.Fatalf("read %d lines, expected %d", n, b.N)
+	}
+}
+
+func BenchmarkLines(b *testing.B) {
+	benchmarkTail(b, Config{}, func(tail *Tail) (n int) {
+		for range tail.Lines {
+			n++
+		}
+		return n
+	})
+}
+
+func BenchmarkRaw(b *testing.B) {
+	for _, raw := range []bool{false, true} {
+		b.Run(fmt.Sprintf("raw=%v", raw), func(b *testing.B) {
+			b.ReportAllocs()
+			benchmarkTail(b, Config{Raw: raw}, func(tail *Tail) (n int) {
+				for range tail.Lines {
+					n++
+				}
+				return n
+			})
+		})
+	}
+}
+
+func BenchmarkReaderBufferSize(b *testing.B) {
+	os.MkdirAll(".test", 0700)
+	filename := ".test/benchmark-10mb.txt"
+	line := []byte("a line of benchmark data\n")
+	content := bytes.Repeat(line, 10<<20/len(line))
+	if err := ioutil.WriteFile(filename, content, 0600); err != nil {
+		b.Fatal(err)
+	}
+	defer os.Remove(filename)
+
+	for _, size := range []int{0, 64 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			b.SetBytes(int64(len(content)))
+			for i := 0; i < b.N; i++ {
+				tail, err := TailFile(filename, Config{Location: -1, ReaderBufferSize: size})
+				if err != nil {
+					b.Fatal(err)
+				}
+				for range tail.Lines {
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkBatches(b *testing.B) {
+	benchmarkTail(b, Config{Batch: 256}, func(tail *Tail) (n int) {
+		for batch := range tail.Batches {
+			n += len(batch)
+		}
+		return n
+	})
+}
+
+func TestDecodeJSON(_t *testing.T) {
+	t := NewTailTest("decodejson", _t)
+	t.CreateFile("test.txt", `{"level":"info","msg":"one"}
+{"level":"warn","msg":"two"}
+{"level":
+{"level":"info","msg":"three"}
+`)
+	tail := t.StartTail("test.txt", Config{Follow: false, Location: -1})
+
+	type entry struct {
+		Level string
+		Msg   string
+	}
+	values, errs := DecodeJSON[entry](tail)
+	var decoded []entry
+	var failures int
+	for values != nil || errs != nil {
+		select {
+		case v, ok := <-values:
+			if !ok {
+				values = nil
+				continue
+			}
+			decoded = append(decoded, v)
+		case _, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			failures++
+		}
+	}
+
+	expected := []entry{{"info", "one"}, {"warn", "two"}, {"info", "three"}}
+	if fmt.Sprint(decoded) != fmt.Sprint(expected) {
+		t.Fatalf("mismatch; %v (actual) != %v (expected)", decoded, expected)
+	}
+	if failures != 1 {
+		t.Fatalf("expected 1 decode error, got %d", failures)
+	}
+
+	// The value left unread is dropped once stopped, closing the
+	// channels.
+	tail = t.StartTail("test.txt", Config{Follow: true, Location: -1})
+	values, errs = DecodeJSON[entry](tail)
+	<-time.After(50 * time.Millisecond)
+	tail.Stop()
+	<-time.After(50 * time.Millisecond)
+	if v, ok := <-values; ok {
+		t.Fatalf("expected values closed once stopped, got %v", v)
+	}
+	if _, ok := <-errs; ok {
+		t.Fatal("expected errors closed once stopped")
+	}
+}
+
+func TestLineParser(_t *testing.T) {
+	t := NewTailTest("lineparser", _t)
+	t.CreateFile("test.txt", `{"log":"starting up\n","stream":"stdout","time":"2024-01-02T15:04:05.123456789Z"}
+{"log":
+{"log":"no such file\n","stream":"stderr","time":"2024-01-02T15:04:06Z"}
+`)
+	tail := t.StartTail("test.txt", Config{Follow: false, Location: -1, LineParser: ParseDockerJSON})
+
+	var lines []*Line
+	var failures int
+	for tail.Lines != nil || tail.Errors != nil {
+		select {
+		case line, ok := <-tail.Lines:
+			if !ok {
+				tail.Lines = nil
+				continue
+			}
+			lines = append(lines, line)
+		case err, ok := <-tail.Errors:
+			if !ok {
+				tail.Errors = nil
+				continue
+			}
+			var tailErr *TailError
+			if !errors.As(err, &tailErr) || tailErr.Op != "parse" {
+				t.Fatalf("expected a TailError parsing the line, got %v", err)
+			}
+			failures++
+		}
+	}
+
+	expected := []struct {
+		text, stream, time string
+	}{
+		{"starting up", "stdout", "2024-01-02T15:04:05.123456789Z"},
+		{"no such file", "stderr", "2024-01-02T15:04:06Z"},
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d lines, got %d", len(expected), len(lines))
+	}
+	for i, line := range lines {
+		e := expected[i]
+		if line.Text != e.text || line.Stream != e.stream || line.Time.Format(time.RFC3339Nano) != e.time {
+			t.Errorf("mismatch; %q %s %s (actual) != %q %s %s (expected)",
+				line.Text, line.Stream, line.Time.Format(time.RFC3339Nano), e.text, e.stream, e.time)
+		}
+		if line.Num != int64(i) {
+			t.Errorf("line %q numbered %d", line.Text, line.Num)
+		}
+	}
+	if failures != 1 {
+		t.Fatalf("expected 1 parse error, got %d", failures)
+	}
+}
+
+func _TestStartTime(_t *testing.T, name string, minutes []int, startMinute int, expected []string) {
+	t := NewTailTest(name, _t)
+	var content strings.Builder
+	for _, m := range minutes {
+		fmt.Fprintf(&content, "Jan  2 15:%02d:00 host app: minute %d\n", m, m)
+		content.WriteString("continued without timestamp\n")
+	}
+	t.CreateFile("test.txt", content.String())
+	parse := func(text string) (time.Time, bool) {
+		if len(text) < len(time.Stamp) {
+			return time.Time{}, false
+		}
+		ts, err := time.Parse(time.Stamp, text[:len(time.Stamp)])
+		return ts, err == nil
+	}
+	start := time.Date(0, time.January, 2, 15, startMinute, 0, 0, time.UTC)
+	tail := t.StartTail("test.txt", Config{Follow: false, TimeParser: parse, StartTime: start})
+	var lines []string
+	for line := range tail.Lines {
+		if strings.HasPrefix(line.Text, "Jan") {
+			lines = append(lines, line.Text[len(time.Stamp)+1:])
+		}
+	}
+	if fmt.Sprint(lines) != fmt.Sprint(expected) {
+		t.Fatalf("mismatch; %q (actual) != %q (expected)", lines, expected)
+	}
+}
+
+func TestStartTime(t *testing.T) {
+	minutes := make([]int, 50)
+	for i := range minutes {
+		minutes[i] = i
+	}
+	_TestStartTime(t, "starttime", minutes, 47,
+		[]string{"host app: minute 47", "host app: minute 48", "host app: minute 49"})
+	_TestStartTime(t, "starttime-all", minutes[10:13], 0,
+		[]string{"host app: minute 10", "host app: minute 11", "host app: minute 12"})
+	_TestStartTime(t, "starttime-none", minutes[:3], 59, nil)
+}
+
+func TestStartTimeUnordered(t *testing.T) {
+	_TestStartTime(t, "starttime-unordered", []int{5, 30, 1, 2, 3, 4, 6, 7, 8}, 20,
+		[]string{"host app: minute 30", "host app: minute 1", "host app: minute 2",
+			"host app: minute 3", "host app: minute 4", "host app: minute 6",
+			"host app: minute 7", "host app: minute 8"})
+}
+
+func TestNotRegularFile(_t *testing.T) {
+	t := NewTailTest("not-regular-file", _t)
+	_, err := TailFile(t.path, Config{Follow: true, MustExist: true})
+	if !errors.Is(err, ErrNotRegularFile) {
+		t.Fatalf("expected ErrNotRegularFile, got %v", err)
+	}
+	if !strings.Contains(err.Error(), t.path) {
+		t.Fatalf("expected the error to name %s: %v", t.path, err)
+	}
+}
+
+func TestPathIsDirectory(_t *testing.T) {
+	t := NewTailTest("path-is-directory", _t)
+	path := t.path + "/test.txt"
+
+	// Without ReOpen, the tail of a directory dies.
+	if err := os.Mkdir(path, 0700); err != nil {
+		t.Fatal(err)
+	}
+	tail := t.StartTail("test.txt", Config{Follow: true, Location: -1})
+	if err := tail.Wait(); !errors.Is(err, ErrPathIsDirectory) {
+		t.Fatalf("expected ErrPathIsDirectory, got %v", err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// With ReOpen, the file replaced by a directory is waited for to
+	// be a file again.
+	t.CreateFile("test.txt", "hello\n")
+	tail = t.StartTail("test.txt", Config{Follow: true, ReOpen: true, Location: -1})
+	t.ReadLines(tail, []string{"hello"})
+	t.RemoveFile("test.txt")
+	if err := os.Mkdir(path, 0700); err != nil {
+		t.Fatal(err)
+	}
+	<-time.After(100 * time.Millisecond)
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	t.CreateFile("test.txt", "world\n")
+	t.ReadLines(tail, []string{"world"})
+	tail.Stop()
+	t.RemoveFile("test.txt")
+}
+
+func TestReaderBufferSize(_t *testing.T) {
+	t := NewTailTest("reader-buffer-size", _t)
+	lines := []string{"short", strings.Repeat("long", 20), "", "last\r"}
+	t.CreateFile("test.txt", strings.Join(lines, "\n")+"\n")
+	tail := t.StartTail("test.txt", Config{Follow: false, Location: -1, ReaderBufferSize: 16})
+	lines[3] = "last"
+	t.VerifyTailOutput(tail, lines)
+}
+
+func TestPreload(_t *testing.T) {
+	t := NewTailTest("preload", _t)
+	long := strings.Repeat("long", 2000)
+	read := func(preload bool) []string {
+		t.CreateFile("test.txt", "one\ntwo\n"+long+"\n")
+		tail := t.StartTail("test.txt", Config{Follow: true, Location: -1, Preload: preload})
+		var lines []string
+		readLines := func(n int) {
+			for i := 0; i < n; i++ {
+				lines = append(lines, (<-tail.Lines).Text)
+			}
+		}
+		readLines(3)
+		t.AppendFile("test.txt", "three\nfour\n")
+		readLines(2)
+
+		// The file is read whole again once truncated.
+		t.TruncateFile("test.txt", "five\nsix\n")
+		readLines(2)
+		tail.Stop()
+		t.RemoveFile("test.txt")
+		return lines
+	}
+
+	streamed, preloaded := read(false), read(true)
+	expected := []string{"one", "two", long, "three", "four", "five", "six"}
+	if fmt.Sprint(streamed) != fmt.Sprint(expected) {
+		t.Fatalf("mismatch; %q (streamed) != %q (expected)", streamed, expected)
+	}
+	if fmt.Sprint(preloaded) != fmt.Sprint(streamed) {
+		t.Fatalf("mismatch; %q (preloaded) != %q (streamed)", preloaded, streamed)
+	}
+}
+
+func TestStripANSI(_t *testing.T) {
+	t := NewTailTest("strip-ansi", _t)
+	t.CreateFile("test.txt", "\x1b[31mRED\x1b[0m\n\x1b[1;32mbold\x1b[m green\n")
+	tail := t.StartTail("test.txt", Config{Follow: false, Location: -1, StripANSI: true})
+	t.VerifyTailOutput(tail, []string{"RED", "bold green"})
+}
+
+func TestSkipEmptyLines(_t *testing.T) {
+	t := NewTailTest("skip-empty-lines", _t)
+	t.CreateFile("test.txt", "one\n\n  \n\t two \r\n\r\nthree\n")
+	for _, test := range []struct {
+		config   Config
+		expected []string
+	}{
+		{Config{}, []string{"one", "", "  ", "\t two ", "", "three"}},
+		{Config{TrimSpace: true}, []string{"one", "", "", "two", "", "three"}},
+		{Config{SkipEmptyLines: true}, []string{"one", "  ", "\t two ", "three"}},
+		{Config{TrimSpace: true, SkipEmptyLines: true}, []string{"one", "two", "three"}},
+	} {
+		test.config.Location = -1
+		tail := t.StartTail("test.txt", test.config)
+		t.VerifyTailOutput(tail, test.expected)
+	}
+	t.RemoveFile("test.txt")
+}
+
+func TestRaw(_t *testing.T) {
+	t := NewTailTest("raw", _t)
+	content := "hello\n\nworld\r\n" + strings.Repeat("long line ", 2<<10) + "\nlast"
+	t.CreateFile("test.txt", content)
+	for _, config := range []Config{{}, {KeepLineEnding: true}, {MaxLineSize: 5}} {
+		config.Location = -1
+		expected, err := ReadAllLines(t.path+"/test.txt", config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Raw = true
+		lines, err := ReadAllLines(t.path+"/test.txt", config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lines) != len(expected) {
+			t.Fatalf("read %d raw lines instead of %d", len(lines), len(expected))
+		}
+		for i, line := range lines {
+			if line.Text != "" || string(line.Raw) != expected[i].Text || line.Offset != expected[i].Offset {
+				t.Fatalf("raw line %q at %d instead of %q at %d", line.Raw, line.Offset, expected[i].Text, expected[i].Offset)
+			}
+		}
+
+		// Lines do not overlap, for appending to one not to
+		// overwrite the next.
+		if len(lines) > 1 {
+			_ = append(lines[0].Raw, 'x')
+			if string(lines[1].Raw) != expected[1].Text {
+				t.Fatalf("raw line %q overwritten", lines[1].Raw)
+			}
+		}
+	}
+	t.RemoveFile("test.txt")
+}
+
+func TestDelimiters(_t *testing.T) {
+	t := NewTailTest("delimiters", _t)
+	long := strings.Repeat("x", 100)
+	t.CreateFile("test.txt", "one\ntwo\x1ethree\x1e\x1e"+long+"\nfour\r\n")
+	tail := t.StartTail("test.txt", Config{
+		Follow:           true,
+		Location:         -1,
+		Delimiters:       []byte("\n\x1e"),
+		ReaderBufferSize: 16})
+	defer tail.Stop()
+	for _, expected := range []Line{
+		{Text: "one", Delimiter: '\n', Offset: 4},
+		{Text: "two", Delimiter: 0x1e, Offset: 8},
+		{Text: "three", Delimiter: 0x1e, Offset: 14},
+		{Text: "", Delimiter: 0x1e, Offset: 15},
+		{Text: long, Delimiter: '\n', Offset: 116},
+		{Text: "four\r", Delimiter: '\n', Offset: 122},
+	} {
+		line := <-tail.Lines
+		if line.Text != expected.Text || line.Delimiter != expected.Delimiter || line.Offset != expected.Offset {
+			t.Fatalf("line %q ended by %q at %d, expected %q ended by %q at %d",
+				line.Text, line.Delimiter, line.Offset, expected.Text, expected.Delimiter, expected.Offset)
+		}
+	}
+
+	// A line read before its delimiter was written has none.
+	t.AppendFile("test.txt", "fi")
+	if line := <-tail.Lines; line.Text != "fi" || line.Delimiter != 0 {
+		t.Fatalf("unexpected line %q ended by %q", line.Text, line.Delimiter)
+	}
+	t.AppendFile("test.txt", "ve\x1e")
+	if line := <-tail.Lines; line.Text != "ve" || line.Delimiter != 0x1e {
+		t.Fatalf("unexpected line %q ended by %q", line.Text, line.Delimiter)
+	}
+
+	// The last line is unterminated, with the delimiter of the line
+	// before it not being a newline.
+	t.CreateFile("unterminated.txt", "a\x1ebcdefg")
+	lines, err := ReadAllLines(t.path+"/unterminated.txt", Config{
+		Location:         -1,
+		Delimiters:       []byte("\n\x1e"),
+		ReaderBufferSize: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 2 || lines[0].Text != "a" || lines[1].Text != "bcdefg" || lines[1].Delimiter != 0 {
+		t.Fatalf("unexpected lines %v", lines)
+	}
+	t.RemoveFile("unterminated.txt")
+
+	if _, err := TailFile("test.txt", Config{Delimiters: []byte("\x1e"), NLines: 1}); err == nil {
+		t.Fatal("expected an error for Delimiters along with NLines")
+	}
+	t.RemoveFile("test.txt")
+}
+
+func TestMaxLag(_t *testing.T) {
+	t := NewTailTest("maxlag", _t)
+	var backlog strings.Builder
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&backlog, "line %02d\n", i)
+	}
+	t.CreateFile("test.txt", backlog.String())
+	tail := t.StartTail("test.txt", Config{Follow: true, Location: -1, MaxLag: 20})
+
+	// Lines start every 8 bytes; those within the last 20 bytes are
+	// kept.
+	marker := <-tail.Lines
+	if marker.Dropped != 98*8 || marker.Text != "" {
+		t.Fatalf("expected a marker for %d dropped bytes, got %+v", 98*8, marker)
+	}
+	t.ReadLines(tail, []string{"line 98", "line 99"})
+
+	// Lines read in time are not dropped.
+	t.AppendFile("test.txt", "line 100\n")
+	t.ReadLines(tail, []string{"line 100"})
+	tail.Stop()
+}
+
+func TestFileInfo(_t *testing.T) {
+	t := NewTailTest("fileinfo", _t)
+	t.CreateFile("test.txt", "hello\n")
+	tail := t.StartTail("test.txt", Config{Follow: true, Location: -1})
+	t.ReadLines(tail, []string{"hello"})
+	fi, err := tail.FileInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 6 {
+		t.Fatalf("expected size 6, got %d", fi.Size())
+	}
+
+	t.AppendFile("test.txt", "world\n")
+	t.ReadLines(tail, []string{"world"})
+	if fi, err = tail.FileInfo(); err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 12 {
+		t.Fatalf("expected size 12, got %d", fi.Size())
+	}
+
+	tail.Stop()
+	if _, err := tail.FileInfo(); err != ErrNoFile {
+		t.Fatalf("expected ErrNoFile once stopped, got %v", err)
+	}
+}
+
+func TestKeepLineEnding(_t *testing.T) {
+	t := NewTailTest("keep-line-ending", _t)
+	t.CreateFile("lf.txt", "hello\nworld\n")
+	t.CreateFile("crlf.txt", "hello\r\nworld\r\n")
+
+	tail := t.StartTail("lf.txt", Config{Follow: false, Location: -1})
+	t.VerifyTailOutput(tail, []string{"hello", "world"})
+	tail = t.StartTail("crlf.txt", Config{Follow: false, Location: -1})
+	t.VerifyTailOutput(tail, []string{"hello", "world"})
+
+	tail = t.StartTail("lf.txt", Config{Follow: false, Location: -1, KeepLineEnding: true})
+	t.VerifyTailOutput(tail, []string{"hello\n", "world\n"})
+	tail = t.StartTail("crlf.txt", Config{Follow: false, Location: -1, KeepLineEnding: true})
+	t.VerifyTailOutput(tail, []string{"hello\r\n", "world\r\n"})
+
+	// Only the last of split lines is terminated.
+	tail = t.StartTail("crlf.txt", Config{Follow: false, Location: -1, KeepLineEnding: true, MaxLineSize: 3})
+	t.VerifyTailOutput(tail, []string{"hel", "lo\r\n", "wor", "ld\r\n"})
+}
+
+func TestLineEnding(_t *testing.T) {
+	t := NewTailTest("line-ending", _t)
+	t.CreateFile("cr.txt", "one\rtwo\rthree\r")
+	t.CreateFile("crlf.txt", "one\ntwo\r\nthree\r\n")
+
+	tail := t.StartTail("cr.txt", Config{Follow: false, Location: -1, LineEnding: LineEndingCR})
+	t.VerifyTailOutput(tail, []string{"one", "two", "three"})
+	tail = t.StartTail("cr.txt", Config{Follow: false, Location: -1, LineEnding: LineEndingAuto})
+	t.VerifyTailOutput(tail, []string{"one", "two", "three"})
+	tail = t.StartTail("cr.txt", Config{Follow: false, NLines: 1, LineEnding: LineEndingAuto, KeepLineEnding: true})
+	t.VerifyTailOutput(tail, []string{"three\r"})
+
+	// Files ending lines otherwise are not taken for "\r" ones.
+	tail = t.StartTail("crlf.txt", Config{Follow: false, Location: -1, LineEnding: LineEndingAuto})
+	t.VerifyTailOutput(tail, []string{"one", "two", "three"})
+	tail = t.StartTail("crlf.txt", Config{Follow: false, Location: -1, LineEnding: LineEndingCRLF})
+	t.VerifyTailOutput(tail, []string{"one\ntwo", "three"})
+}
+
+func TestCRLF(_t *testing.T) {
+	t := NewTailTest("crlf", _t)
+	t.CreateFile("test.txt", "hello\r\ncarriage\rreturn\r\n\r\n")
+	tail := t.StartTail("test.txt", Config{Follow: false, Location: -1})
+
+	// Only the \r terminating a line is stripped.
+	t.VerifyTailOutput(tail, []string{"hello", "carriage\rreturn", ""})
+}
+
+// blockingWatcher is a FileWatcher that only reports the file to
+// exist when told so, even if the tail is stopped meanwhile.
+type blockingWatcher struct {
+	fakeWatcher
+	exists chan bool
+}
+
+func (fw *blockingWatcher) BlockUntilExists(t *tomb.Tomb) error {
+	<-fw.exists
+	return nil
+}
+
+func TestClose(_t *testing.T) {
+	t := NewTailTest("close", _t)
+	// The file is to be missing, even if left by a previous run.
+	t.RemoveDir()
+	t.CreateDir()
+	fw := &blockingWatcher{exists: make(chan bool)}
+	tail := t.StartTail("test.txt", Config{
+		Follow:   true,
+		ReOpen:   true,
+		Location: -1,
+		WatcherFactory: func(string) watch.FileWatcher {
+			return fw
+		}})
+
+	// Close returns while the tail is still stuck waiting for the file.
+	if err := tail.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-tail.Dead():
+		t.Fatal("tail ended before the watcher returned")
+	case <-time.After(100 * time.Millisecond):
+	}
+	t.CreateFile("test.txt", "hello\n")
+	select {
+	case fw.exists <- true:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the tail to wait for the file")
+	}
+	select {
+	case <-tail.Dead():
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the tail to end")
+	}
+
+	// The file is closed without calling Wait.
+	if _, err := tail.FileInfo(); err != ErrNoFile {
+		t.Fatalf("expected ErrNoFile once closed, got %v", err)
+	}
+}
+
+func TestConcurrentStop(_t *testing.T) {
+	t := NewTailTest("concurrent-stop", _t)
+	t.CreateFile("test.txt", "hello\n")
+	for _, poll := range []bool{false, true} {
+		// One tail reading a file, the other waiting for one.
+		tails := []*Tail{
+			t.StartTail("test.txt", Config{Follow: true, Location: -1, Poll: poll}),
+			t.StartTail("missing.txt", Config{Follow: true, ReOpen: true, Location: -1, Poll: poll}),
+		}
+		t.ReadLines(tails[0], []string{"hello"})
+		<-time.After(50 * time.Millisecond)
+		for _, tail := range tails {
+			var wg sync.WaitGroup
+			errs := make(chan error, 10)
+			for i := 0; i < cap(errs); i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					errs <- tail.Stop()
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if err != nil {
+					t.Fatalf("poll=%v: Stop of %s returned %v", poll, tail.Filename, err)
+				}
+			}
+			if _, ok := <-tail.Lines; ok {
+				t.Fatalf("poll=%v: Lines of %s not closed", poll, tail.Filename)
+			}
+		}
+	}
+	t.RemoveFile("test.txt")
+}
+
+func TestTailReader(_t *testing.T) {
+	t := NewTailTest("tail-reader", _t)
+	r, w := io.Pipe()
+	tail, err := TailReader(r, Config{Follow: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		io.WriteString(w, "hello\nworld\n")
+		<-time.After(100 * time.Millisecond)
+		io.WriteString(w, "again\n")
+		w.Close()
+	}()
+
+	// The tail ends once the writer is done.
+	t.VerifyTailOutput(tail, []string{"hello", "world", "again"})
+}
+
+func TestMustExistTimeout(_t *testing.T) {
+	t := NewTailTest("must-exist-timeout", _t)
+	go func() {
+		<-time.After(50 * time.Millisecond)
+		// Renamed into place, for the file not to be read before
+		// its content is written.
+		t.CreateFile("test.txt.new", "hello\n")
+		t.RenameFile("test.txt.new", "test.txt")
+	}()
+	tail, err := TailFile(t.path+"/test.txt", Config{Location: -1, MustExist: true, MustExistTimeout: 500 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("file was not waited for: %v", err)
+	}
+	t.VerifyTailOutput(tail, []string{"hello"})
+
+	// The file is no longer waited for after the timeout.
+	start := time.Now()
+	_, err = TailFile(t.path+"/missing.txt", Config{MustExist: true, MustExistTimeout: 100 * time.Millisecond})
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected a not exist error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("waited for %s for the missing file", elapsed)
+	}
+}
+
+func TestLocationEndCreated(_t *testing.T) {
+	t := NewTailTest("location-end-created", _t)
+	// All of a file created once tailing began is new.
+	tail := t.StartTail("test.txt", Config{Follow: true, Location: LocationEnd})
+	t.CreateFile("test.txt", "hello\nworld\n")
+	t.ReadLines(tail, []string{"hello", "world"})
+	tail.Stop()
+	t.RemoveFile("test.txt")
+}
+
+func TestWriteAfterStart(_t *testing.T) {
+	t := NewTailTest("write-after-start", _t)
+	for _, poll := range []bool{false, true} {
+		for i := 0; i < 10; i++ {
+			t.CreateFile("test.txt", "old\n")
+			tail := t.StartTail("test.txt", Config{Follow: true, Location: 0, Poll: poll})
+			// Written before the tail seeked to the end of the file.
+			t.AppendFile("test.txt", "new\n")
+			t.ReadLines(tail, []string{"new"})
+			tail.Stop()
+			t.RemoveFile("test.txt")
+		}
+	}
+}
+
+func TestHeartbeat(_t *testing.T) {
+	t := NewTailTest("heartbeat", _t)
+	t.CreateFile("test.txt", "hello\n")
+	tail := t.StartTail("test.txt", Config{Follow: true, Location: -1, ReportEvents: true, HeartbeatInterval: 50 * time.Millisecond})
+	defer tail.Stop()
+	t.ReadLines(tail, []string{"hello"})
+
+	// Heartbeats keep coming while the file is idle.
+	for i := 0; i < 3; i++ {
+		t.VerifyEvent(tail, EventHeartbeat)
+	}
+
+	// They pause while lines are read, which come in order.
+	go func() {
+		for i := 0; i < 20; i++ {
+			t.AppendFile("test.txt", fmt.Sprintf("line %d\n", i))
+			<-time.After(5 * time.Millisecond)
+		}
+	}()
+	var heartbeats int
+	for i := 0; i < 20; {
+		select {
+		case line := <-tail.Lines:
+			if expected := fmt.Sprintf("line %d", i); line.Text != expected {
+				t.Fatalf("mismatch; %s (actual) != %s (expected)", line.Text, expected)
+			}
+			i++
+		case event := <-tail.Events:
+			if event.Type != EventHeartbeat {
+				t.Fatalf("unexpected event %v", event.Type)
+			}
+			heartbeats++
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for line %d", i)
+		}
+	}
+	if heartbeats > 1 {
+		t.Fatalf("%d heartbeats were delivered while lines were read", heartbeats)
+	}
+	t.VerifyEvent(tail, EventHeartbeat)
+}
+
+func TestWaitTimeout(_t *testing.T) {
+	t := NewTailTest("wait-timeout", _t)
+	for _, poll := range []bool{false, true} {
+		config := Config{Follow: true, ReOpen: true, Location: -1, Poll: poll, WaitTimeout: 100 * time.Millisecond}
+
+		// The file never appears.
+		tail := t.StartTail("missing.txt", config)
+		if err := tail.Wait(); !errors.Is(err, ErrWaitTimeout) {
+			t.Fatalf("poll=%v: expected ErrWaitTimeout for a missing file, got %v", poll, err)
+		}
+
+		// The file is not recreated once removed.
+		t.CreateFile("test.txt", "hello\n")
+		tail = t.StartTail("test.txt", config)
+		t.VerifyTailOutputAsync(tail, []string{"hello"})
+		<-time.After(50 * time.Millisecond)
+		start := time.Now()
+		t.RemoveFile("test.txt")
+		if err := tail.Wait(); !errors.Is(err, ErrWaitTimeout) {
+			t.Fatalf("poll=%v: expected ErrWaitTimeout once removed, got %v", poll, err)
+		}
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > time.Second {
+			t.Fatalf("poll=%v: waited for %s for the file to reappear", poll, elapsed)
+		}
+	}
+}
+
+func TestWatcherError(_t *testing.T) {
+	t := NewTailTest("watcher-error", _t)
+	t.CreateFile("test.txt", "hello\n")
+	defer func(orig func(string) (watch.FileWatcher, error)) { newInotifyWatcher = orig }(newInotifyWatcher)
+
+	failure := &os.SyscallError{Syscall: "inotify_init", Err: syscall.EACCES}
+	newInotifyWatcher = func(string) (watch.FileWatcher, error) { return nil, failure }
+	if _, err := TailFile(t.path+"/test.txt", Config{Follow: true}); err != failure {
+		t.Fatalf("expected the watcher error, got %v", err)
+	}
+
+	// Running out of inotify instances or watches, once the file is
+	// watched, falls back to polling.
+	for _, errno := range []syscall.Errno{syscall.EMFILE, syscall.ENOSPC} {
+		newInotifyWatcher = func(string) (watch.FileWatcher, error) {
+			return &failingWatcher{errno}, nil
+		}
+		tail := t.StartTail("test.txt", Config{Follow: true, Location: -1})
+		t.ReadLines(tail, []string{"hello"})
+		t.AppendFile("test.txt", "world\n")
+		t.ReadLines(tail, []string{"world"})
+		tail.Stop()
+		t.CreateFile("test.txt", "hello\n")
+	}
+
+	// Other failures end the tail.
+	newInotifyWatcher = func(string) (watch.FileWatcher, error) {
+		return &failingWatcher{syscall.EACCES}, nil
+	}
+	tail := t.StartTail("test.txt", Config{Follow: true, Location: -1})
+	t.ReadLines(tail, []string{"hello"})
+	if err := tail.Wait(); !errors.Is(err, syscall.EACCES) {
+		t.Fatalf("expected the watcher error, got %v", err)
+	}
+}
+
+// failingWatcher is a FileWatcher failing to watch the file with err.
+type failingWatcher struct {
+	err error
+}
+
+func (fw *failingWatcher) BlockUntilExists(t *tomb.Tomb) error {
+	return nil
+}
+
+func (fw *failingWatcher) ChangeEvents(t *tomb.Tomb, fi os.FileInfo) (*watch.FileChanges, error) {
+	return nil, fw.err
+}
+
+func TestCopyTruncate(_t *testing.T) {
+	t := NewTailTest("copytruncate", _t)
+	t.CreateFile("test.txt", "a\nb\n")
+	fw := &fakeWatcher{make(chan *watch.FileChanges, 1)}
+	tail := t.StartTail("test.txt", Config{
+		Follow:   true,
+		Location: -1,
+		WatcherFactory: func(string) watch.FileWatcher {
+			return fw
+		}})
+	t.ReadLines(tail, []string{"a", "b"})
+	changes := <-fw.changes
+
+	// The truncation is reported before the last line written to the
+	// file was read, and before the file is actually truncated.
+	t.AppendFile("test.txt", "c\n")
+	changes.Truncated <- true
+	t.ReadLines(tail, []string{"c"})
+
+	t.TruncateFile("test.txt", "d\n")
+	changes.Modified <- true
+	t.ReadLines(tail, []string{"d"})
+	tail.Stop()
+}
+
+func TestAll(_t *testing.T) {
+	t := NewTailTest("all", _t)
+	t.CreateFile("test.txt", "a\nb\nc\nd\n")
+	tail := t.StartTail("test.txt", Config{Follow: true, Location: -1})
+	var lines []string
+	for line, err := range tail.All() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line.Text)
+		if len(lines) == 2 {
+			break
+		}
+	}
+	if fmt.Sprint(lines) != "[a b]" {
+		t.Fatalf("mismatch; %v (actual) != [a b] (expected)", lines)
+	}
+
+	// Breaking out stopped the tail.
+	select {
+	case <-tail.Dead():
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the tail to stop")
+	}
+}
+
+func TestAllError(_t *testing.T) {
+	t := NewTailTest("all-error", _t)
+	t.CreateFile("test.txt", "a\nb\nc\n")
+	tail := t.StartTail("test.txt", Config{Location: -1, MaxBytes: 2})
+	var lines []string
+	var errs []error
+	for line, err := range tail.All() {
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		lines = append(lines, line.Text)
+	}
+	if fmt.Sprint(lines) != "[a]" || len(errs) != 1 || errs[0] != ErrMaxBytesReached {
+		t.Fatalf("unexpected lines %v and errors %v", lines, errs)
+	}
+}
+
+func TestLocationFull(_t *testing.T) {
+	t := NewTailTest("location-full", _t)
+	t.CreateFile("test.txt", "hello\nworld\n")
+	tail := t.StartTail("test.txt", Config{Follow: true, Location: -1})
+	t.VerifyTailOutputAsync(tail, []string{"hello", "world"})
+
+	// Delete after a reasonable delay, to give tail sufficient time
+	// to read all lines.
+	<-time.After(100 * time.Millisecond)
+	t.RemoveFile("test.txt")
+	tail.Stop()
+}
+
+func TestLocationFullDontFollow(_t *testing.T) {
+	t := NewTailTest("location-full-dontfollow", _t)
+	t.CreateFile("test.txt", "hello\nworld\n")
+	tail := t.StartTail("test.txt", Config{Follow: false, Location: -1})
+	t.VerifyTailOutputAsync(tail, []string{"hello", "world"})
+
+	// Add more data only after reasonable delay.
+	<-time.After(100 * time.Millisecond)
+	t.AppendFile("test.txt", "more\ndata\n")
+	<-time.After(100 * time.Millisecond)
+
+	tail.Stop()
+}
+
+func TestLocationEnd(_t *testing.T) {
+	t := NewTailTest("location-end", _t)
+	t.CreateFile("test.txt", "hello\nworld\n")
+	tail := t.StartTail("test.txt", Config{Follow: true, Location: LocationEnd})
+	t.VerifyTailOutputAsync(tail, []string{"more", "data"})
+
+	<-time.After(100 * time.Millisecond)
+	t.AppendFile("test.txt", "more\ndata\n")
+
+	// Delete after a reasonable delay, to give tail sufficient time
+	// to read all lines.
+	<-time.After(100 * time.Millisecond)
+	t.RemoveFile("test.txt")
+	tail.Stop()
+}
+
+func TestLocationPastEnd(_t *testing.T) {
+	t := NewTailTest("location-past-end", _t)
+	t.CreateFile("test.txt", "hello\nworld\n")
+	tail := t.StartTail("test.txt", Config{Follow: true, Location: -100})
+	t.VerifyTailOutputAsync(tail, []string{"more", "data"})
+
+	// Starting beyond the end must not skip data appended later.
+	<-time.After(100 * time.Millisecond)
+	t.AppendFile("test.txt", "more\ndata\n")
+
+	// Delete after a reasonable delay, to give tail sufficient time
+	// to read all lines.
+	<-time.After(100 * time.Millisecond)
+	t.RemoveFile("test.txt")
+	tail.Stop()
+}
+
+func TestLocationLastBytes(_t *testing.T) {
+	t := NewTailTest("location-last-bytes", _t)
+	t.CreateFile("test.txt", "hello\nworld\n")
+	tail := t.StartTail("test.txt", Config{Follow: false, Location: 6})
+	t.VerifyTailOutput(tail, []string{"world"})
+
+	// More bytes than the file holds start at its beginning.
+	tail = t.StartTail("test.txt", Config{Follow: false, Location: 100})
+	t.VerifyTailOutput(tail, []string{"hello", "world"})
+}
+
+func TestSkipHeaderLines(_t *testing.T) {
+	t := NewTailTest("skip-header-lines", _t)
+	t.CreateFile("test.txt", "a,b,c\n1,2\n")
+	tail := t.StartTail("test.txt", Config{Follow: false, Location: -1, SkipHeaderLines: 1, MaxLineSize: 3})
+	t.VerifyTailOutput(tail, []string{"1,2"})
+
+	// Only the beginning of the file is a header.
+	tail = t.StartTail("test.txt", Config{Follow: false, Location: 4, SkipHeaderLines: 1})
+	t.VerifyTailOutput(tail, []string{"1,2"})
+
+	// Files rotated in are skipped the header of as well if asked.
+	tail = t.StartTail("test.txt", Config{Follow: true, ReOpen: true, Location: -1, SkipHeaderLines: 1, SkipHeaderOnReopen: true})
+	t.ReadLines(tail, []string{"1,2"})
+	t.RenameFile("test.txt", "test.txt.rotated")
+	t.CreateFile("test.txt", "a,b,c\n3,4\n")
+	t.ReadLines(tail, []string{"3,4"})
+	tail.Stop()
+}
+
+func TestStartPercent(_t *testing.T) {
+	t := NewTailTest("start-percent", _t)
+	// The midpoint, at offset 14, falls within the second line.
+	t.CreateFile("test.txt", "line one\nline two\nline three\n")
+	tail := t.StartTail("test.txt", Config{Follow: true, StartPercent: 50})
+	t.ReadLines(tail, []string{"line three"})
+	t.AppendFile("test.txt", "line four\n")
+	t.ReadLines(tail, []string{"line four"})
+	tail.Stop()
+
+	// No line left to begin past the midpoint starts at the end.
+	t.CreateFile("last.txt", "one\na longer last line")
+	tail = t.StartTail("last.txt", Config{Follow: false, StartPercent: 50})
+	t.VerifyTailOutput(tail, nil)
+
+	if _, err := TailFile(t.path+"/test.txt", Config{StartPercent: 101}); err == nil {
+		t.Fatal("expected an error for a StartPercent over 100")
+	}
+}
+
+func TestStartLine(_t *testing.T) {
+	t := NewTailTest("start-line", _t)
+	var content string
+	var expected []string
+	for i := 1; i <= 10; i++ {
+		content += fmt.Sprintf("line %d\n", i)
+		if i >= 3 {
+			expected = append(expected, fmt.Sprintf("line %d", i))
+		}
+	}
+	t.CreateFile("test.txt", content)
+	tail := t.StartTail("test.txt", Config{Follow: true, StartLine: 3})
+	t.ReadLines(tail, expected)
+	t.AppendFile("test.txt", "line 11\n")
+	t.ReadLines(tail, []string{"line 11"})
+	tail.Stop()
+
+	// With fewer lines, the file is followed from its end.
+	tail = t.StartTail("test.txt", Config{Follow: true, StartLine: 20})
+	<-tail.Started()
+	t.AppendFile("test.txt", "line 12\n")
+	t.ReadLines(tail, []string{"line 12"})
+	tail.Stop()
+
+	if _, err := TailFile(t.path+"/test.txt", Config{StartLine: 3, NLines: 2}); err == nil {
+		t.Fatal("expected an error for StartLine along with NLines")
+	}
+}
+
+func _TestReOpen(_t *testing.T, poll bool) {
+	var name string
+	if poll {
+		name = "reopen-polling"
+	} else {
+		name = "reopen-inotify"
+	}
+	t := NewTailTest(name, _t)
+	t.CreateFile("test.txt", "hello\nworld\n")
+	tail := t.StartTail(
+		"test.txt",
+		Config{Follow: true, ReOpen: true, Poll: poll, Location: -1})
+
+	t.VerifyTailOutputAsync(tail, []string{"hello", "world", "more", "data", "endofworld"})
+
+	// deletion must trigger reopen
+	<-time.After(100 * time.Millisecond)
+	t.RemoveFile("test.txt")
+	<-time.After(100 * time.Millisecond)
+	t.CreateFile("test.txt", "more\ndata\n")
+
+	// rename must trigger reopen
+	<-time.After(100 * time.Millisecond)
+	t.RenameFile("test.txt", "test.txt.rotated")
+	<-time.After(100 * time.Millisecond)
+	t.CreateFile("test.txt", "endofworld")
+
+	// Delete after a reasonable delay, to give tail sufficient time
+	// to read all lines.
+	<-time.After(100 * time.Millisecond)
+	t.RemoveFile("test.txt")
+	<-time.After(100 * time.Millisecond)
+
+	// Do not bother with stopping as it could kill the tomb during
+	// the reading of data written above. Timings can vary based on
+	// test environment.
+	// tail.Stop()
+}
+
+func _TestFlapping(_t *testing.T, poll bool) {
+	var name string
+	if poll {
+		name = "flapping-polling"
+	} else {
+		name = "flapping-inotify"
+	}
+	t := NewTailTest(name, _t)
+	tail := t.StartTail(
+		"test.txt",
+		Config{Follow: true, ReOpen: true, Poll: poll, Location: -1})
+
+	// The file comes and goes, both while the tail waits for it to
+	// exist and while it is open.
+	for i := 0; i < 20; i++ {
+		t.CreateFile("test.txt", "")
+		t.RemoveFile("test.txt")
+		if i%5 == 0 {
+			<-time.After(10 * time.Millisecond)
+		}
+	}
+	t.CreateFile("test.txt", "final\n")
+
+	t.ReadLines(tail, []string{"final"})
+	if err := tail.Stop(); err != nil {
+		t.Fatalf("tail failed after flapping: %s", err)
+	}
+}
+
+func TestFlappingInotify(_t *testing.T) {
+	_TestFlapping(_t, false)
+}
+
+func TestFlappingPolling(_t *testing.T) {
+	_TestFlapping(_t, true)
+}
+
+func _TestDeleteWhileBusy(_t *testing.T, poll bool) {
+	var name string
+	if poll {
+		name = "delete-while-busy-polling"
+	} else {
+		name = "delete-while-busy-inotify"
+	}
+	t := NewTailTest(name, _t)
+
+	// The deletion is reported while the tail is blocked delivering a
+	// line, and handled as such once it is read, rather than taken for
+	// a rotation.
+	for i := 0; i < 10; i++ {
+		clock := newFakeClock()
+		t.CreateFile("test.txt", "hello\nworld\n")
+		tail := t.StartTail("test.txt", Config{
+			Follow:       true,
+			Poll:         poll,
+			Clock:        clock,
+			ReportEvents: true,
+			Location:     -1})
+		if poll {
+			clock.BlockUntil(1)
+		}
+		t.RemoveFile("test.txt")
+		if poll {
+			clock.Advance(watch.POLL_DURATION)
+		}
+		<-time.After(20 * time.Millisecond)
+		t.ReadLines(tail, []string{"hello", "world"})
+		t.VerifyEvent(tail, EventFileDeleted)
+		t.VerifyTailOutput(tail, nil)
+	}
+}
+
+func TestDeleteWhileBusyInotify(_t *testing.T) {
+	_TestDeleteWhileBusy(_t, false)
+}
+
+func TestDeleteWhileBusyPolling(_t *testing.T) {
+	_TestDeleteWhileBusy(_t, true)
+}
+
+func TestLineNum(_t *testing.T) {
+	t := NewTailTest("line-num", _t)
+	t.CreateFile("test.txt", "hello\nworld\n")
+	tail := t.StartTail("test.txt", Config{Follow: true, ReOpen: true, Location: -1, MaxLineSize: 3})
+
+	// Split lines are numbered separately; numbering goes on once
+	// the file is rotated.
+	expected := []string{"hel", "lo", "wor", "ld", "end"}
+	go func() {
+		<-time.After(100 * time.Millisecond)
+		t.RenameFile("test.txt", "test.txt.rotated")
+		<-time.After(100 * time.Millisecond)
+		t.CreateFile("test.txt", "end\n")
+	}()
+	for i, text := range expected {
+		line := <-tail.Lines
+		if line.Text != text || line.Num != int64(i) {
+			t.Fatalf("expected line %d to be %q, got %d: %q", i, text, line.Num, line.Text)
+		}
+	}
+	tail.Stop()
+}
+
+func TestFollowSymlinks(_t *testing.T) {
+	t := NewTailTest("follow-symlinks", _t)
+	t.CreateFile("a.txt", "hello\n")
+	t.CreateFile("b.txt", "world\n")
+	if err := os.Symlink("a.txt", t.path+"/current"); err != nil {
+		t.Fatal(err)
+	}
+	tail := t.StartTail("current", Config{Follow: true, Location: -1, FollowSymlinks: true})
+	t.ReadLines(tail, []string{"hello"})
+
+	// Repoint the link atomically, as `ln -sfn` followed by `mv -T` do.
+	if err := os.Symlink("b.txt", t.path+"/current.new"); err != nil {
+		t.Fatal(err)
+	}
+	t.RenameFile("current.new", "current")
+	t.ReadLines(tail, []string{"world"})
+	tail.Stop()
+}
+
+func TestMultiTail(_t *testing.T) {
+	t := NewTailTest("multitail", _t)
+	t.CreateFile("a.txt", "hello\n")
+	t.CreateFile("b.txt", "world\n")
+	mt, err := NewMultiTail(Config{Follow: true, Location: -1}, t.path+"/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line := <-mt.Lines; line.Text != "hello" {
+		t.Fatalf("mismatch; %q (actual) != %q (expected)", line.Text, "hello")
+	}
+
+	// A file added at runtime is tailed as well.
+	if err := mt.Add(t.path + "/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if line := <-mt.Lines; line.Text != "world" || line.Filename != t.path+"/b.txt" {
+		t.Fatalf("unexpected line %q from %s", line.Text, line.Filename)
+	}
+	if files := mt.Files(); fmt.Sprint(files) != fmt.Sprint([]string{t.path + "/a.txt", t.path + "/b.txt"}) {
+		t.Fatalf("unexpected files %v", files)
+	}
+
+	// Lines of a removed file are no longer delivered.
+	if err := mt.Remove(t.path + "/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if files := mt.Files(); fmt.Sprint(files) != fmt.Sprint([]string{t.path + "/b.txt"}) {
+		t.Fatalf("unexpected files %v", files)
+	}
+	t.AppendFile("a.txt", "ignored\n")
+	t.AppendFile("b.txt", "again\n")
+	if line := <-mt.Lines; line.Text != "again" {
+		t.Fatalf("mismatch; %q (actual) != %q (expected)", line.Text, "again")
+	}
+
+	if err := mt.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-mt.Lines; ok {
+		t.Fatal("Lines not closed once stopped")
+	}
+}
+
+func TestMultiTailRemove(_t *testing.T) {
+	t := NewTailTest("multitail-remove", _t)
+	mt, err := NewMultiTail(Config{Follow: true, Location: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// No line is delivered once Remove returns, even as lines are being
+	// received all along.
+	var removed atomic.Int64 // Files removed so far, in order
+	late := make(chan int)
+	go func() {
+		n := 0
+		for {
+			k := removed.Load()
+			line, ok := <-mt.Lines
+			if !ok {
+				break
+			}
+			var i int64
+			fmt.Sscanf(filepath.Base(line.Filename), "test-%d.txt", &i)
+			if i < k {
+				n++
+			}
+		}
+		late <- n
+	}()
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("test-%d.txt", i)
+		t.CreateFile(name, strings.Repeat("hello\n", 10000))
+		if err := mt.Add(t.path + "/" + name); err != nil {
+			t.Fatal(err)
+		}
+		<-time.After(time.Millisecond)
+		if err := mt.Remove(t.path + "/" + name); err != nil {
+			t.Fatal(err)
+		}
+		removed.Add(1)
+		t.RemoveFile(name)
+	}
+	if err := mt.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if n := <-late; n > 0 {
+		t.Fatalf("%d lines delivered once removed", n)
+	}
+}
+
+func TestReleaseFDWhenIdle(_t *testing.T) {
+	t := NewTailTest("release-fd-when-idle", _t)
+	t.CreateFile("test.txt", "hello\n")
+	tail := t.StartTail("test.txt", Config{Follow: true, ReOpen: true, Location: -1, ReleaseFDWhenIdle: 50 * time.Millisecond})
+	t.ReadLines(tail, []string{"hello"})
+
+	// The file is closed once idle, then opened again as it is
+	// appended, to be read on from where it was left.
+	for _, text := range []string{"world", "again"} {
+		t.VerifyOpenFiles(0)
+		if _, err := tail.FileInfo(); err != ErrNoFile {
+			t.Fatalf("expected ErrNoFile while idle, got %v", err)
+		}
+		offset, _ := tail.Position()
+		t.AppendFile("test.txt", text+"\n")
+		line := <-tail.Lines
+		if line.Text != text || line.Offset != offset+int64(len(text))+1 {
+			t.Fatalf("mismatch; %s at %d (actual) != %s after %d (expected)", line.Text, line.Offset, text, offset)
+		}
+	}
+	tail.Stop()
+}
+
+func TestTailLatest(_t *testing.T) {
+	t := NewTailTest("tail-latest", _t)
+	t.CreateFile("app-2024-01-01.log", "old\n")
+	t.CreateFile("app-2024-01-02.log", "first\n")
+	t.CreateFile("other.log", "ignored\n")
+	lt, err := TailLatest(t.path+"/app-*.log", Config{Location: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line := <-lt.Lines; line.Text != "first" {
+		t.Fatalf("mismatch; %q (actual) != %q (expected)", line.Text, "first")
+	}
+
+	// The current file is read up to its end before a newer one, which
+	// is read from its beginning.
+	t.AppendFile("app-2024-01-02.log", "second\n")
+	t.CreateFile("app-2024-01-03.log", "third\n")
+	for _, expected := range []string{"second", "third"} {
+		select {
+		case line := <-lt.Lines:
+			if line.Text != expected {
+				t.Fatalf("mismatch; %q (actual) != %q (expected)", line.Text, expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %q", expected)
+		}
+	}
+	if filename := lt.Filename(); filename != t.path+"/app-2024-01-03.log" {
+		t.Fatalf("tailing %s instead of the newest file", filename)
+	}
+	t.AppendFile("app-2024-01-02.log", "late\n")
+	t.AppendFile("app-2024-01-03.log", "fourth\n")
+	if line := <-lt.Lines; line.Text != "fourth" {
+		t.Fatalf("mismatch; %q (actual) != %q (expected)", line.Text, "fourth")
+	}
+
+	if err := lt.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-lt.Lines; ok {
+		t.Fatal("Lines not closed once stopped")
+	}
+	for _, name := range []string{"app-2024-01-01.log", "app-2024-01-02.log", "app-2024-01-03.log", "other.log"} {
+		t.RemoveFile(name)
+	}
+}
+
+func TestTailLatestCollapseRepeats(_t *testing.T) {
+	t := NewTailTest("tail-latest-collapse-repeats", _t)
+	t.CreateFile("app-2024-01-01.log", "first\nfirst\n")
+	lt, err := TailLatest(t.path+"/app-*.log", Config{Location: -1, CollapseRepeats: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for lt.Filename() == "" {
+		<-time.After(10 * time.Millisecond)
+	}
+
+	// The line held back for repeats is delivered before switching to
+	// a newer file.
+	t.CreateFile("app-2024-01-02.log", "second\nthird\n")
+	for _, expected := range []string{"first", "second"} {
+		select {
+		case line := <-lt.Lines:
+			if line.Text != expected {
+				t.Fatalf("mismatch; %q (actual) != %q (expected)", line.Text, expected)
+			}
+			if expected == "first" && line.Repeat != 2 {
+				t.Fatalf("%q repeated %d times; expected 2", line.Text, line.Repeat)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %q", expected)
+		}
+	}
+
+	if err := lt.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"app-2024-01-01.log", "app-2024-01-02.log"} {
+		t.RemoveFile(name)
+	}
+}
+
+func TestMultiTailMaxOpenFiles(_t *testing.T) {
+	t := NewTailTest("multitail-max-open-files", _t)
+	names := []string{"a.txt", "b.txt", "c.txt"}
+	var paths []string
+	for _, name := range names {
+		t.CreateFile(name, name+"\n")
+		paths = append(paths, t.path+"/"+name)
+	}
+	mt, err := NewMultiTail(Config{Follow: true, ReOpen: true, Location: -1, MaxOpenFiles: 2}, paths...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := make(map[string]bool)
+	for range names {
+		read[(<-mt.Lines).Text] = true
+	}
+	if len(read) != len(names) {
+		t.Fatalf("unexpected lines %v", read)
+	}
+	t.VerifyOpenFiles(2)
+
+	// Files closed in the meantime are opened again as they are
+	// appended, for none of their lines to be lost.
+	for i := 0; i < 3; i++ {
+		for _, name := range names {
+			text := fmt.Sprintf("%s %d", name, i)
+			t.AppendFile(name, text+"\n")
+			if line := <-mt.Lines; line.Text != text {
+				t.Fatalf("mismatch; %q (actual) != %q (expected)", line.Text, text)
+			}
+			t.VerifyOpenFiles(2)
+		}
+	}
+	if err := mt.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func _TestDirRemoved(_t *testing.T, poll bool) {
+	var name string
+	if poll {
+		name = "dir-removed-polling"
+	} else {
+		name = "dir-removed-inotify"
+	}
+	t := NewTailTest(name, _t)
+	t.CreateFile("test.txt", "hello\n")
+	tail := t.StartTail(
+		"test.txt",
+		Config{Follow: true, ReOpen: true, Poll: poll, Location: -1})
+	t.ReadLines(tail, []string{"hello"})
+
+	// removing the directory must wait for both directory and file
+	// to be recreated
+	<-time.After(100 * time.Millisecond)
+	t.RemoveDir()
+	<-time.After(100 * time.Millisecond)
+	t.CreateDir()
+	<-time.After(100 * time.Millisecond)
+	t.CreateFile("test.txt", "world\n")
+	t.ReadLines(tail, []string{"world"})
+	tail.Stop()
+}
+
+func TestDirRemovedInotify(_t *testing.T) {
+	_TestDirRemoved(_t, false)
+}
+
+func TestDirRemovedPolling(_t *testing.T) {
+	_TestDirRemoved(_t, true)
+}
+
+func TestRotationGoroutines(_t *testing.T) {
+	t := NewTailTest("rotation-goroutines", _t)
+	t.CreateFile("test.txt", "0\n")
+	before := runtime.NumGoroutine()
+	tail := t.StartTail(
+		"test.txt",
+		Config{Follow: true, ReOpen: true, Poll: true, Location: -1})
+	t.ReadLines(tail, []string{"0"})
+
+	for i := 1; i <= 20; i++ {
+		<-time.After(20 * time.Millisecond)
+		t.RenameFile("test.txt", "test.txt.rotated")
+		t.CreateFile("test.txt", fmt.Sprintf("%d\n", i))
+		t.ReadLines(tail, []string{fmt.Sprint(i)})
+	}
+	tail.Stop()
+
+	// Watcher goroutines of the rotated files must all be gone.
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines leaked; %d (actual) > %d (expected)",
+				runtime.NumGoroutine(), before)
+		}
+		<-time.After(10 * time.Millisecond)
+	}
+}
+
+// _TestFollowMode renames the file while it has unread data, which is
+// only read when following by descriptor.
+func _TestFollowMode(_t *testing.T, mode FollowMode, expected []string) {
+	var name string
+	if mode == FollowByName {
+		name = "followmode-name"
+	} else {
+		name = "followmode-descriptor"
+	}
+	t := NewTailTest(name, _t)
+	clock := newFakeClock()
+	t.CreateFile("test.txt", "hello\n")
+	tail := t.StartTail(
+		"test.txt",
+		Config{FollowMode: mode, Poll: true, Clock: clock, Location: -1})
+	t.ReadLines(tail, []string{"hello"})
+
+	clock.BlockUntil(1)
+	t.AppendFile("test.txt", "old\n")
+	t.RenameFile("test.txt", "test.txt.rotated")
+	t.CreateFile("test.txt", "new\n")
+	clock.Advance(watch.POLL_DURATION)
+	t.ReadLines(tail, expected)
+	tail.Stop()
+}
+
+func TestFollowByDescriptor(_t *testing.T) {
+	_TestFollowMode(_t, FollowByDescriptor, []string{"old"})
+}
+
+func TestFollowByName(_t *testing.T) {
+	// The rest of the rotated file is read first.
+	_TestFollowMode(_t, FollowByName, []string{"old", "new"})
+}
+
+func TestFollowFile(_t *testing.T) {
+	t := NewTailTest("follow-file", _t)
+	t.CreateFile("test.txt", "old\n")
+	tail, err := FollowFile(t.path + "/test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tail.Stop()
+
+	// Only lines appended are read, across rotations.
+	t.AppendFile("test.txt", "appended\n")
+	t.ReadLines(tail, []string{"appended"})
+	<-time.After(50 * time.Millisecond)
+	t.RenameFile("test.txt", "test.txt.1")
+	t.CreateFile("test.txt", "rotated\n")
+	t.ReadLines(tail, []string{"rotated"})
+	t.RemoveFile("test.txt")
+	t.RemoveFile("test.txt.1")
+}
+
+// The use of polling file watcher could affect file rotation
+// (detected via renames), so test these explicitly.
+
+func TestReOpenInotify(_t *testing.T) {
+	_TestReOpen(_t, false)
+}
+
+func TestReOpenPolling(_t *testing.T) {
+	_TestReOpen(_t, true)
+}
+
+func TestInotifyInodeSwap(_t *testing.T) {
+	t := NewTailTest("inotify-inode-swap", _t)
+	// Swapping the symlink to the parent directory replaces the file
+	// with no event about it or the directory watched, as the copy-up
+	// of overlayfs does.
+	swap := func(dir string) {
+		os.Remove(t.path + "/current.new")
+		if err := os.Symlink(dir, t.path+"/current.new"); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(t.path+"/current.new", t.path+"/current"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, dir := range []string{"a", "b", "c"} {
+		if err := os.MkdirAll(t.path+"/"+dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		t.CreateFile(dir+"/test.txt", dir+"\n")
+	}
+	config := Config{Follow: true, ReOpen: true, Location: -1, ReportEvents: true}
+
+	// The periodic check notices the swap.
+	swap("a")
+	config.InotifyCheckInterval = 20 * time.Millisecond
+	tail := t.StartTail("current/test.txt", config)
+	t.ReadLines(tail, []string{"a"})
+	<-time.After(50 * time.Millisecond)
+	swap("b")
+	t.VerifyEvent(tail, EventRotated)
+	t.VerifyEvent(tail, EventReopened)
+	t.ReadLines(tail, []string{"b"})
+	tail.Stop()
+
+	// So does a modification of the file replaced, without checks.
+	config.InotifyCheckInterval = 0
+	tail = t.StartTail("current/test.txt", config)
+	t.ReadLines(tail, []string{"b"})
+	<-time.After(50 * time.Millisecond)
+	swap("c")
+	t.AppendFile("b/test.txt", "late\n")
+	t.ReadLines(tail, []string{"late"})
+	t.VerifyEvent(tail, EventRotated)
+	t.VerifyEvent(tail, EventReopened)
+	t.ReadLines(tail, []string{"c"})
+	tail.Stop()
+}
+
+func TestEventRotated(_t *testing.T) {
+	t := NewTailTest("event-rotated", _t)
+	t.CreateFile("test.txt", "hello\n")
+	tail := t.StartTail(
+		"test.txt",
+		Config{Follow: true, ReOpen: true, ReportEvents: true, Location: -1})
+	t.ReadLines(tail, []string{"hello"})
+
+	<-time.After(100 * time.Millisecond)
+	t.RenameFile("test.txt", "test.txt.rotated")
+	t.VerifyEvent(tail, EventRotated)
+
+	t.CreateFile("test.txt", "more\n")
+	t.VerifyEvent(tail, EventReopened)
+	t.ReadLines(tail, []string{"more"})
+	tail.Stop()
+}
+
+func TestRotationDrain(_t *testing.T) {
+	t := NewTailTest("rotation-drain", _t)
+	t.CreateFile("test.txt", "hello\n")
+	fw := &fakeWatcher{make(chan *watch.FileChanges, 1)}
+	tail := t.StartTail("test.txt", Config{
+		Follow:       true,
+		ReOpen:       true,
+		ReportEvents: true,
+		Location:     -1,
+		WatcherFactory: func(string) watch.FileWatcher {
+			return fw
+		}})
+	t.ReadLines(tail, []string{"hello"})
+
+	// The file is rotated before the tail is told of the lines
+	// appended to it last, once it waits for changes; these are read
+	// before those of the new file, including the unterminated one.
+	changes := <-fw.changes
+	<-time.After(50 * time.Millisecond)
+	t.AppendFile("test.txt", "unread\nunterminated")
+	t.RenameFile("test.txt", "test.txt.rotated")
+	t.CreateFile("test.txt", "more\n")
+	changes.NotifyRenamed()
+
+	t.ReadLines(tail, []string{"unread", "unterminated"})
+	if event := t.VerifyEvent(tail, EventRotated); event.Lost != 0 {
+		t.Fatalf("expected no bytes lost, got %d", event.Lost)
+	}
+	t.VerifyEvent(tail, EventReopened)
+	t.ReadLines(tail, []string{"more"})
+	<-fw.changes
+	tail.Stop()
+}
+
+// failingReader fails reading while fail is set.
+type failingReader struct {
+	r    io.Reader
+	fail *atomic.Bool
+}
+
+func (r failingReader) Read(p []byte) (int, error) {
+	if r.fail.Load() {
+		return 0, &os.PathError{Op: "read", Path: "test.txt", Err: syscall.EIO}
+	}
+	return r.r.Read(p)
+}
+
+func TestLostBytes(_t *testing.T) {
+	t := NewTailTest("lost-bytes", _t)
+	t.CreateFile("test.txt", "hello\n")
+	var fail atomic.Bool
+	newFileReader = func(file io.Reader) io.Reader { return failingReader{file, &fail} }
+	defer func() { newFileReader = func(file io.Reader) io.Reader { return file } }()
+	fw := &fakeWatcher{make(chan *watch.FileChanges, 1)}
+	tail := t.StartTail("test.txt", Config{
+		Follow:       true,
+		ReOpen:       true,
+		ReportEvents: true,
+		Location:     -1,
+		WatcherFactory: func(string) watch.FileWatcher {
+			return fw
+		}})
+	t.ReadLines(tail, []string{"hello"})
+
+	// The rest of the rotated file fails to be read.
+	changes := <-fw.changes
+	<-time.After(50 * time.Millisecond)
+	fail.Store(true)
+	t.AppendFile("test.txt", "unread\n")
+	t.RenameFile("test.txt", "test.txt.rotated")
+	t.CreateFile("test.txt", "more\n")
+	changes.NotifyRenamed()
+
+	if event := t.VerifyEvent(tail, EventRotated); event.Lost != 7 {
+		t.Fatalf("expected 7 bytes lost, got %d", event.Lost)
+	}
+	fail.Store(false)
+	t.VerifyEvent(tail, EventReopened)
+	t.ReadLines(tail, []string{"more"})
+	if lost := tail.LostBytes(); lost != 7 {
+		t.Fatalf("expected LostBytes of 7, got %d", lost)
+	}
+	<-fw.changes
+	tail.Stop()
+}
+
+// countingReader counts the reads of the file.
+type countingReader struct {
+	r     io.Reader
+	reads *atomic.Int64
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	r.reads.Add(1)
+	return r.r.Read(p)
+}
+
+func TestEmptyWakeups(_t *testing.T) {
+	t := NewTailTest("empty-wakeups", _t)
+	t.CreateFile("test.txt", "hello\n")
+	var reads atomic.Int64
+	newFileReader = func(file io.Reader) io.Reader { return countingReader{file, &reads} }
+	defer func() { newFileReader = func(file io.Reader) io.Reader { return file } }()
+	fw := &fakeWatcher{make(chan *watch.FileChanges, 1)}
+	tail := t.StartTail("test.txt", Config{
+		Follow:   true,
+		Location: -1,
+		WatcherFactory: func(string) watch.FileWatcher {
+			return fw
+		}})
+	t.ReadLines(tail, []string{"hello"})
+
+	// Notifications without data to read are backed off from, rather
+	// than spun on.
+	changes := <-fw.changes
+	before := reads.Load()
+	for start := time.Now(); time.Since(start) < 200*time.Millisecond; {
+		changes.NotifyModified()
+		time.Sleep(100 * time.Microsecond)
+	}
+	if n := reads.Load() - before; n > 20 {
+		t.Fatalf("file read %d times on empty change notifications", n)
+	}
+
+	// Data is still read promptly once there is some.
+	t.AppendFile("test.txt", "world\n")
+	changes.NotifyModified()
+	t.ReadLines(tail, []string{"world"})
+	tail.Stop()
+}
+
+func TestWatcherFactory(_t *testing.T) {
+	t := NewTailTest("watcher-factory", _t)
+	t.CreateFile("test.txt", "hello\n")
+	fw := &fakeWatcher{make(chan *watch.FileChanges, 1)}
+	tail := t.StartTail("test.txt", Config{
+		Follow:   true,
+		Location: -1,
+		WatcherFactory: func(string) watch.FileWatcher {
+			return fw
+		}})
+	t.ReadLines(tail, []string{"hello"})
+
+	// Change notifications are delivered only when the test says so.
+	changes := <-fw.changes
+	t.AppendFile("test.txt", "world\n")
+	changes.Modified <- true
+	t.ReadLines(tail, []string{"world"})
+
+	changes.Deleted <- true
+	t.VerifyTailOutput(tail, nil)
+}
+
+func _TestTruncateRewrite(_t *testing.T, poll bool) {
+	var name string
+	if poll {
+		name = "truncate-rewrite-polling"
+	} else {
+		name = "truncate-rewrite-inotify"
+	}
+	t := NewTailTest(name, _t)
+	t.CreateFile("test.txt", "hello\nworld\n")
+	tail := t.StartTail(
+		"test.txt",
+		Config{Follow: true, ReOpen: false, Poll: poll, Location: -1})
+	t.ReadLines(tail, []string{"hello", "world"})
+
+	// Truncate and immediately write more than the previous content,
+	// so that the file never appears to shrink.
+	<-time.After(100 * time.Millisecond)
+	t.TruncateFile("test.txt", "h311o\nw0r1d\nendofworld\n")
+	t.ReadLines(tail, []string{"h311o", "w0r1d", "endofworld"})
+	tail.Stop()
+}
+
+func TestTruncateRewriteInotify(_t *testing.T) {
+	_TestTruncateRewrite(_t, false)
+}
+
+func TestTruncateRewritePolling(_t *testing.T) {
+	_TestTruncateRewrite(_t, true)
+}
+
+func TestTruncateInPlace(_t *testing.T) {
+	t := NewTailTest("truncate-in-place", _t)
+	t.CreateFile("test.txt", "hello\nworld\n")
+	fw := &fakeWatcher{make(chan *watch.FileChanges, 1)}
+	tail := t.StartTail("test.txt", Config{
+		Follow:       true,
+		ReOpen:       true,
+		ReportEvents: true,
+		Location:     -1,
+		WatcherFactory: func(string) watch.FileWatcher {
+			return fw
+		}})
+	t.ReadLines(tail, []string{"hello", "world"})
+	changes := <-fw.changes
+
+	t.TruncateFile("test.txt", "new\n")
+	changes.NotifyTruncated()
+	t.VerifyEvent(tail, EventTruncated)
+	t.ReadLines(tail, []string{"new"})
+
+	// The file was seeked back to its beginning, not reopened, which
+	// would also have registered the watcher anew.
+	select {
+	case <-fw.changes:
+		t.Fatal("watcher registered again")
+	default:
+	}
+	select {
+	case event := <-tail.Events:
+		t.Fatalf("unexpected event %v", event.Type)
+	case <-time.After(50 * time.Millisecond):
+	}
+	tail.Stop()
+}
+
+// The polling watcher is driven by a fake clock, so that no sleeps
+// are needed to order the file changes with the polls.
+func _TestReSeek(_t *testing.T, poll bool) {
+	var name string
+	if poll {
+		name = "reseek-polling"
+	} else {
+		name = "reseek-inotify"
+	}
+	t := NewTailTest(name, _t)
+	clock := newFakeClock()
+	t.CreateFile("test.txt", "a really long string goes here\nhello\nworld\n")
+	tail := t.StartTail(
+		"test.txt",
+		Config{Follow: true, ReOpen: false, Poll: poll, Clock: clock, Location: -1})
+	t.ReadLines(tail, []string{"a really long string goes here", "hello", "world"})
+
+	// truncate once the watcher is waiting for its next poll
+	if poll {
+		clock.BlockUntil(1)
+	}
+	t.TruncateFile("test.txt", "h311o\nw0r1d\nendofworld\n")
+	if poll {
+		clock.Advance(watch.POLL_DURATION)
+	}
+	t.ReadLines(tail, []string{"h311o", "w0r1d", "endofworld"})
+
+	// deletion stops the tail
+	if poll {
+		clock.BlockUntil(1)
+	}
+	t.RemoveFile("test.txt")
+	if poll {
+		clock.Advance(watch.POLL_DURATION)
+	}
+	t.VerifyTailOutput(tail, nil)
+}
+
+// The use of polling file watcher could affect file rotation
+// (detected via renames), so test these explicitly.
+
+func TestReSeekInotify(_t *testing.T) {
+	_TestReSeek(_t, false)
+}
+
+func TestReSeekPolling(_t *testing.T) {
+	_TestReSeek(_t, true)
 }
 
-func TestMustExist(t *testing.T) {
-	tail, err := TailFile("/no/such/file", Config{Follow: true, MustExist: true})
-	if err == nil {
-		t.Error("MustExist:true is violated")
-		tail.Stop()
+func TestCoalesceModified(_t *testing.T) {
+	t := NewTailTest("coalesce-modified", _t)
+
+	// Notifications of each kind collapse into one, independently.
+	fc := watch.NewFileChanges()
+	for i := 0; i < 1000; i++ {
+		fc.NotifyModified()
 	}
-	tail, err = TailFile("/no/such/file", Config{Follow: true, MustExist: false})
-	if err != nil {
-		t.Error("MustExist:false is violated")
+	fc.NotifyTruncated()
+	fc.NotifyDeleted()
+	if len(fc.Modified) != 1 || len(fc.Truncated) != 1 || len(fc.Deleted) != 1 {
+		t.Fatalf("pending notifications: %d modified, %d truncated, %d deleted",
+			len(fc.Modified), len(fc.Truncated), len(fc.Deleted))
 	}
-	tail.Stop()
-	_, err = TailFile("README.md", Config{Follow: true, MustExist: true})
-	if err != nil {
-		t.Error("MustExist:true on an existing file is violated")
+
+	t.CreateFile("test.txt", "")
+	fw := &fakeWatcher{make(chan *watch.FileChanges, 1)}
+	tail := t.StartTail("test.txt", Config{
+		Follow:   true,
+		Location: -1,
+		WatcherFactory: func(string) watch.FileWatcher {
+			return fw
+		}})
+	changes := <-fw.changes
+
+	// The tail blocks on sending the first line, leaving a single
+	// wakeup pending for all of the following ones.
+	lines := make([]string, 1000)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("line %d", i)
+		t.AppendFile("test.txt", lines[i]+"\n")
+		changes.NotifyModified()
+	}
+	if n := len(changes.Modified); n != 1 {
+		t.Fatalf("expected 1 pending wakeup, got %d", n)
 	}
+	t.ReadLines(tail, lines)
 	tail.Stop()
+
+	// A deletion reported while a modification is pending is handled
+	// as such, rather than missed.
+	t.CreateFile("test.txt", "hello\n")
+	tail = t.StartTail("test.txt", Config{
+		Follow:       true,
+		ReportEvents: true,
+		Location:     -1,
+		WatcherFactory: func(string) watch.FileWatcher {
+			return fw
+		}})
+	changes = <-fw.changes
+	t.AppendFile("test.txt", "world\n")
+	changes.NotifyModified()
+	t.RemoveFile("test.txt")
+	changes.NotifyDeleted()
+	if len(changes.Modified) != 1 || len(changes.Deleted) != 1 {
+		t.Fatalf("pending notifications: %d modified, %d deleted",
+			len(changes.Modified), len(changes.Deleted))
+	}
+	t.ReadLines(tail, []string{"hello", "world"})
+	t.VerifyEvent(tail, EventFileDeleted)
+	t.VerifyTailOutput(tail, nil)
 }
 
-func TestMaxLineSize(_t *testing.T) {
-	t := NewTailTest("maxlinesize", _t)
-	t.CreateFile("test.txt", "hello\nworld\nfin\nhe")
-	tail := t.StartTail("test.txt", Config{Follow: true, Location: -1, MaxLineSize: 3})
-	go t.VerifyTailOutput(tail, []string{"hel", "lo", "wor", "ld", "fin", "he"})
+// Test library
 
-	// Delete after a reasonable delay, to give tail sufficient time
-	// to read all lines.
-	<-time.After(100 * time.Millisecond)
-	t.RemoveFile("test.txt")
+var (
+	_ watch.FileWatcher = (*watch.InotifyFileWatcher)(nil)
+	_ watch.FileWatcher = (*watch.PollingFileWatcher)(nil)
+)
+
+func TestFollowHandoff(_t *testing.T) {
+	t := NewTailTest("follow-handoff", _t)
+	t.CreateFile("test.txt", "hello\n")
+	fw := &handoffWatcher{write: func() { t.AppendFile("test.txt", "world\n") }}
+	tail := t.StartTail("test.txt", Config{
+		Follow:   true,
+		Location: -1,
+		WatcherFactory: func(string) watch.FileWatcher {
+			return fw
+		}})
+	t.ReadLines(tail, []string{"hello"})
+
+	select {
+	case line := <-tail.Lines:
+		if line.Text != "world" {
+			t.Fatalf("mismatch; %s (actual) != world (expected)", line.Text)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("line appended while registering the watcher was not read")
+	}
 	tail.Stop()
 }
 
-func TestLocationFull(_t *testing.T) {
-	t := NewTailTest("location-full", _t)
-	t.CreateFile("test.txt", "hello\nworld\n")
-	tail := t.StartTail("test.txt", Config{Follow: true, Location: -1})
-	go t.VerifyTailOutput(tail, []string{"hello", "world"})
+func TestFS(_t *testing.T) {
+	t := NewTailTest("fs", _t)
+	m := newMemFS()
+	m.Create("app.log", "hello\n")
+	tail, err := TailFile("app.log", Config{FS: m, Poll: true, Follow: true, ReOpen: true, Location: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.ReadLines(tail, []string{"hello"})
 
-	// Delete after a reasonable delay, to give tail sufficient time
-	// to read all lines.
-	<-time.After(100 * time.Millisecond)
-	t.RemoveFile("test.txt")
+	m.Append("app.log", "world\n")
+	t.ReadLines(tail, []string{"world"})
+
+	// The file is rotated once its last line is read.
+	m.Append("app.log", "last\n")
+	t.ReadLines(tail, []string{"last"})
+	m.Rename("app.log", "app.log.1")
+	m.Create("app.log", "new\n")
+	t.ReadLines(tail, []string{"new"})
 	tail.Stop()
 }
 
-func TestLocationFullDontFollow(_t *testing.T) {
-	t := NewTailTest("location-full-dontfollow", _t)
-	t.CreateFile("test.txt", "hello\nworld\n")
-	tail := t.StartTail("test.txt", Config{Follow: false, Location: -1})
-	go t.VerifyTailOutput(tail, []string{"hello", "world"})
+func TestPollHashSize(_t *testing.T) {
+	t := NewTailTest("poll-hash-size", _t)
+	// Files of memFS have no modification time, as if it had not
+	// changed within the second.
+	m := newMemFS()
+	m.Create("app.log", "hello\n")
+	tail, err := TailFile("app.log", Config{FS: m, Poll: true, Follow: true, Location: -1, PollHashSize: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.ReadLines(tail, []string{"hello"})
 
-	// Add more data only after reasonable delay.
-	<-time.After(100 * time.Millisecond)
-	t.AppendFile("test.txt", "more\ndata\n")
-	<-time.After(100 * time.Millisecond)
+	// Rapid appends are all noticed.
+	for _, line := range []string{"a", "b", "c"} {
+		m.Append("app.log", line+"\n")
+	}
+	t.ReadLines(tail, []string{"a", "b", "c"})
 
+	// So is the file being rewritten as long as it was.
+	m.Rewrite("app.log", "howdy\nA\nB\nC\n")
+	t.ReadLines(tail, []string{"howdy", "A", "B", "C"})
 	tail.Stop()
 }
 
-func TestLocationEnd(_t *testing.T) {
-	t := NewTailTest("location-end", _t)
-	t.CreateFile("test.txt", "hello\nworld\n")
-	tail := t.StartTail("test.txt", Config{Follow: true, Location: 0})
-	go t.VerifyTailOutput(tail, []string{"more", "data"})
+func TestAdaptivePollInterval(_t *testing.T) {
+	t := NewTailTest("adaptive-poll-interval", _t)
+	clock := newFakeClock()
+	t.CreateFile("test.txt", "hello\n")
+	tail := t.StartTail("test.txt", Config{
+		Follow:          true,
+		Poll:            true,
+		Location:        -1,
+		Clock:           clock,
+		PollMinInterval: 100 * time.Millisecond,
+		PollMaxInterval: time.Second})
+	defer tail.Stop()
+	t.ReadLines(tail, []string{"hello"})
+	fw := tail.watcher.(*watch.PollingFileWatcher)
 
-	<-time.After(100 * time.Millisecond)
-	t.AppendFile("test.txt", "more\ndata\n")
+	// poll has the file polled once the next poll is pending, and
+	// returns the interval until the following one, which is to
+	// differ.
+	poll := func(expected time.Duration) time.Duration {
+		for fw.Interval() != expected {
+			<-time.After(time.Millisecond)
+		}
+		clock.Advance(expected)
+		for fw.Interval() == expected {
+			<-time.After(time.Millisecond)
+		}
+		return fw.Interval()
+	}
+	for fw.Interval() == 0 {
+		<-time.After(time.Millisecond)
+	}
+	interval := fw.Interval()
 
-	// Delete after a reasonable delay, to give tail sufficient time
-	// to read all lines.
-	<-time.After(100 * time.Millisecond)
+	// The interval doubles while the file is idle, up to the ceiling.
+	for interval < time.Second {
+		next := poll(interval)
+		if next != min(2*interval, time.Second) {
+			t.Fatalf("interval grew from %s to %s while idle", interval, next)
+		}
+		interval = next
+	}
+
+	// It is halved during a burst of writes, down to the floor.
+	for i := 0; interval > 100*time.Millisecond; i++ {
+		t.AppendFile("test.txt", fmt.Sprintf("line %d\n", i))
+		next := poll(interval)
+		if next != max(interval/2, 100*time.Millisecond) {
+			t.Fatalf("interval went from %s to %s during a burst", interval, next)
+		}
+		t.ReadLines(tail, []string{fmt.Sprintf("line %d", i)})
+		interval = next
+	}
+
+	// And grows again once quiet.
+	if next := poll(interval); next != 2*interval {
+		t.Fatalf("interval went from %s to %s once quiet", interval, next)
+	}
 	t.RemoveFile("test.txt")
-	tail.Stop()
 }
 
-func _TestReOpen(_t *testing.T, poll bool) {
-	var name string
-	if poll {
-		name = "reopen-polling"
-	} else {
-		name = "reopen-inotify"
+func TestHealthCheck(_t *testing.T) {
+	t := NewTailTest("health-check", _t)
+	t.CreateFile("test.txt", "hello\n")
+	fw := &fakeWatcher{make(chan *watch.FileChanges, 1)}
+	tail := t.StartTail("test.txt", Config{
+		Follow:              true,
+		Location:            -1,
+		HealthCheckInterval: 50 * time.Millisecond,
+		WatcherFactory: func(string) watch.FileWatcher {
+			return fw
+		}})
+	t.ReadLines(tail, []string{"hello"})
+	<-fw.changes
+
+	// The watcher never reports the line appended, once the tail
+	// waits for changes.
+	<-time.After(20 * time.Millisecond)
+	t.AppendFile("test.txt", "world\n")
+	select {
+	case line := <-tail.Lines:
+		if line.Text != "world" {
+			t.Fatalf("mismatch; %s (actual) != world (expected)", line.Text)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("tail did not recover from a missed change")
 	}
-	t := NewTailTest(name, _t)
-	t.CreateFile("test.txt", "hello\nworld\n")
-	tail := t.StartTail(
-		"test.txt",
-		Config{Follow: true, ReOpen: true, Poll: poll, Location: -1})
+	tail.Stop()
+}
 
-	go t.VerifyTailOutput(tail, []string{"hello", "world", "more", "data", "endofworld"})
+func TestInotifyMissedEvents(_t *testing.T) {
+	t := NewTailTest("inotify-missed-events", _t)
+	t.CreateFile("test.txt", "hello\n")
+	fw, err := watch.NewInotifyFileWatcher(t.path + "/test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.CheckInterval = 10 * time.Millisecond
+	fi, err := os.Stat(t.path + "/test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	// deletion must trigger reopen
-	<-time.After(100 * time.Millisecond)
+	// Data appended before the watch is registered raises no event,
+	// like that whose events were dropped on an overflow of the inotify
+	// queue; the file is resynced once its check finds it, and watched
+	// on.
+	t.AppendFile("test.txt", "world\n")
+	var tmb tomb.Tomb
+	defer tmb.Kill(nil)
+	changes, err := fw.ChangeEvents(&tmb, fi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-changes.Modified:
+		case <-changes.Deleted:
+			t.Fatal("unexpected deletion")
+		case <-changes.Renamed:
+			t.Fatal("unexpected rename")
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for the change to be found")
+		}
+		if i == 0 {
+			t.AppendFile("test.txt", "again\n")
+		}
+	}
 	t.RemoveFile("test.txt")
-	<-time.After(100 * time.Millisecond)
-	t.CreateFile("test.txt", "more\ndata\n")
+}
 
-	// rename must trigger reopen
-	<-time.After(100 * time.Millisecond)
-	t.RenameFile("test.txt", "test.txt.rotated")
-	<-time.After(100 * time.Millisecond)
-	t.CreateFile("test.txt", "endofworld")
+func TestWatcherCancellation(_t *testing.T) {
+	t := NewTailTest("watcher-cancellation", _t)
+	inotify, err := watch.NewInotifyFileWatcher(t.path + "/missing.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	polling, err := watch.NewPollingFileWatcher(t.path + "/missing.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	// Delete after a reasonable delay, to give tail sufficient time
-	// to read all lines.
-	<-time.After(100 * time.Millisecond)
-	t.RemoveFile("test.txt")
-	<-time.After(100 * time.Millisecond)
+	for _, fw := range []watch.FileWatcher{inotify, polling} {
+		var tmb tomb.Tomb
+		done := make(chan error)
+		go func() { done <- fw.BlockUntilExists(&tmb) }()
+		<-time.After(50 * time.Millisecond)
+		tmb.Kill(nil)
+		select {
+		case err := <-done:
+			if err != tomb.ErrDying {
+				t.Fatalf("%T: expected tomb.ErrDying, got %v", fw, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%T: timeout waiting for cancellation", fw)
+		}
+	}
+}
 
-	// Do not bother with stopping as it could kill the tomb during
-	// the reading of data written above. Timings can vary based on
-	// test environment.
-	// tail.Stop()
+// fakeWatcher is a FileWatcher whose change notifications are driven
+// by the test.
+type fakeWatcher struct {
+	changes chan *watch.FileChanges
 }
 
-// The use of polling file watcher could affect file rotation
-// (detected via renames), so test these explicitly.
+func (fw *fakeWatcher) BlockUntilExists(t *tomb.Tomb) error {
+	return nil
+}
 
-func TestReOpenInotify(_t *testing.T) {
-	_TestReOpen(_t, false)
+func (fw *fakeWatcher) ChangeEvents(t *tomb.Tomb, fi os.FileInfo) (*watch.FileChanges, error) {
+	changes := watch.NewFileChanges()
+	select {
+	case fw.changes <- changes:
+	case <-t.Dying():
+	}
+	return changes, nil
 }
 
-func TestReOpenPolling(_t *testing.T) {
-	_TestReOpen(_t, true)
+// memFS is an fs.FS of files held in memory, which tests change while
+// they are tailed. Files are told apart by their Sys value.
+type memFS struct {
+	mu    sync.Mutex
+	files fstest.MapFS
+	gen   int
 }
 
-func _TestReSeek(_t *testing.T, poll bool) {
-	var name string
-	if poll {
-		name = "reseek-polling"
-	} else {
-		name = "reseek-inotify"
+func newMemFS() *memFS {
+	return &memFS{files: fstest.MapFS{}}
+}
+
+func (m *memFS) Open(name string) (fs.File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := m.files.Open(name)
+	if err != nil {
+		return nil, err
 	}
-	t := NewTailTest(name, _t)
-	t.CreateFile("test.txt", "a really long string goes here\nhello\nworld\n")
-	tail := t.StartTail(
-		"test.txt",
-		Config{Follow: true, ReOpen: false, Poll: poll, Location: -1})
+	return &memFile{f.(seekableFile), &m.mu}, nil
+}
+
+func (m *memFS) Create(name string, contents string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gen++
+	m.files[name] = &fstest.MapFile{Data: []byte(contents), Sys: m.gen}
+}
 
-	go t.VerifyTailOutput(tail, []string{
-		"a really long string goes here", "hello", "world", "h311o", "w0r1d", "endofworld"})
+func (m *memFS) Append(name string, contents string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[name].Data = append(m.files[name].Data, contents...)
+}
 
-	// truncate now
-	<-time.After(100 * time.Millisecond)
-	t.TruncateFile("test.txt", "h311o\nw0r1d\nendofworld\n")
+// Rewrite replaces the contents of a file in place.
+func (m *memFS) Rewrite(name string, contents string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[name].Data = []byte(contents)
+}
 
-	// Delete after a reasonable delay, to give tail sufficient time
-	// to read all lines.
-	<-time.After(100 * time.Millisecond)
-	t.RemoveFile("test.txt")
+func (m *memFS) Rename(oldname string, newname string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[newname] = m.files[oldname]
+	delete(m.files, oldname)
+}
 
-	// Do not bother with stopping as it could kill the tomb during
-	// the reading of data written above. Timings can vary based on
-	// test environment.
-	// tail.Stop()
+// memFile is a file of memFS, accessed under the lock of its memFS.
+type memFile struct {
+	seekableFile
+	mu *sync.Mutex
 }
 
-// The use of polling file watcher could affect file rotation
-// (detected via renames), so test these explicitly.
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fi, err := f.seekableFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return memFileInfo{fi, fi.Size()}, nil
+}
 
-func TestReSeekInotify(_t *testing.T) {
-	_TestReSeek(_t, false)
+// memFileInfo is the FileInfo of a memFile, with its size taken when
+// stat'ed, as that of fstest.MapFS is read from the file as it grows.
+type memFileInfo struct {
+	fs.FileInfo
+	size int64
 }
 
-func TestReSeekPolling(_t *testing.T) {
-	_TestReSeek(_t, true)
+func (fi memFileInfo) Size() int64 {
+	return fi.size
 }
 
-// Test library
+func (f *memFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.seekableFile.Read(p)
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.seekableFile.ReadAt(p, off)
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.seekableFile.Seek(offset, whence)
+}
+
+// handoffWatcher is a FileWatcher calling write while being
+// registered, that is after the tail reached EOF but before any change
+// could be reported. No change is reported afterwards.
+type handoffWatcher struct {
+	fakeWatcher
+	write func()
+}
+
+func (fw *handoffWatcher) ChangeEvents(t *tomb.Tomb, fi os.FileInfo) (*watch.FileChanges, error) {
+	fw.write()
+	return watch.NewFileChanges(), nil
+}
+
+// fakeClock is a watch.Clock whose time only moves when advanced by
+// the test.
+type fakeClock struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	deadline time.Time
+	ch       chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	c := &fakeClock{now: time.Unix(0, 0)}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeWaiter{c.now.Add(d), ch})
+	c.cond.Broadcast()
+	return ch
+}
+
+// Advance moves the clock forward, firing the timers that expire.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.deadline.After(c.now) {
+			pending = append(pending, w)
+		} else {
+			w.ch <- c.now
+		}
+	}
+	c.waiters = pending
+}
+
+// BlockUntil waits until at least n timers are pending.
+func (c *fakeClock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.waiters) < n {
+		c.cond.Wait()
+	}
+}
 
 type TailTest struct {
 	Name string
@@ -198,16 +3516,22 @@ type TailTest struct {
 
 func NewTailTest(name string, t *testing.T) TailTest {
 	tt := TailTest{name, ".test/" + name, t}
-	err := os.MkdirAll(tt.path, os.ModeTemporary|0700)
+	tt.CreateDir()
+	return tt
+}
+
+func (t TailTest) CreateDir() {
+	err := os.MkdirAll(t.path, os.ModeTemporary|0700)
 	if err != nil {
-		tt.Fatal(err)
+		t.Fatal(err)
 	}
+}
 
-	// Use a smaller poll duration for faster test runs. Keep it below
-	// 100ms (which value is used as common delays for tests)
-	watch.POLL_DURATION = 5 * time.Millisecond
-
-	return tt
+func (t TailTest) RemoveDir() {
+	err := os.RemoveAll(t.path)
+	if err != nil {
+		t.Fatal(err)
+	}
 }
 
 func (t TailTest) CreateFile(name string, contents string) {
@@ -265,7 +3589,8 @@ func (t TailTest) StartTail(name string, config Config) *Tail {
 	return tail
 }
 
-func (t TailTest) VerifyTailOutput(tail *Tail, lines []string) {
+// ReadLines verifies that the next lines read from tail match lines.
+func (t TailTest) ReadLines(tail *Tail, lines []string) {
 	for idx, line := range lines {
 		tailedLine, ok := <-tail.Lines
 		if !ok {
@@ -283,8 +3608,93 @@ func (t TailTest) VerifyTailOutput(tail *Tail, lines []string) {
 				tailedLine.Text, line)
 		}
 	}
+}
+
+func (t TailTest) VerifyPosition(tail *Tail, expected int64) {
+	offset, err := tail.Position()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != expected {
+		t.Fatalf("mismatch; position %d (actual) != %d (expected)", offset, expected)
+	}
+}
+
+func (t TailTest) VerifyEvent(tail *Tail, expected EventType) Event {
+	var event Event
+	select {
+	case e, ok := <-tail.Events:
+		if !ok {
+			t.Fatalf("tail ended early; expecting event %v", expected)
+		}
+		if e.Type != expected {
+			t.Fatalf("mismatch; event %v (actual) != %v (expected)",
+				e.Type, expected)
+		}
+		event = e
+	case <-time.After(time.Second):
+		t.Fatalf("timeout waiting for event %v", expected)
+	}
+	return event
+}
+
+// VerifyOpenFiles waits for at most max files of the test directory
+// to be open by the process, as found in /proc.
+func (t TailTest) VerifyOpenFiles(max int) {
+	dir, err := filepath.Abs(t.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		entries, err := os.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Skip("cannot list open files: ", err)
+		}
+		var open int
+		for _, entry := range entries {
+			target, err := os.Readlink("/proc/self/fd/" + entry.Name())
+			if err == nil && strings.HasPrefix(target, dir+"/") {
+				open++
+			}
+		}
+		if open <= max {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d files open; expected at most %d", open, max)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (t TailTest) VerifyTailOutput(tail *Tail, lines []string) {
+	t.ReadLines(tail, lines)
 	line, ok := <-tail.Lines
 	if ok {
 		t.Fatalf("more content from tail: %s", line.Text)
 	}
 }
+
+// VerifyTailOutputAsync verifies the output of tail as VerifyTailOutput
+// does, but from a goroutine of its own, so that the test can go on
+// changing the file meanwhile. As only the test goroutine may stop the
+// test, mismatches are reported with Errorf.
+func (t TailTest) VerifyTailOutputAsync(tail *Tail, lines []string) {
+	go func() {
+		for idx, expected := range lines {
+			line, ok := <-tail.Lines
+			if !ok {
+				t.Errorf("tail ended early; expecting more: %v", lines[idx:])
+				return
+			}
+			if line.Text != expected {
+				t.Errorf("mismatch; %s (actual) != %s (expected)", line.Text, expected)
+				return
+			}
+		}
+		if line, ok := <-tail.Lines; ok {
+			t.Errorf("more content from tail: %s", line.Text)
+		}
+	}()
+}
@@ -1,14 +1,44 @@
 package watch
 
+import (
+	"sync"
+)
+
 type FileChanges struct {
 	Modified chan bool  // Channel to get notified of modifications
 	Truncated chan bool // Channel to get notified of truncations
-	Deleted chan bool  // Channel to get notified of deletions/renames
+	Deleted chan bool  // Channel to get notified of deletions
+	Renamed chan bool  // Channel to get notified of renames/rotations
+
+	stopping chan struct{} // Closed when the receiver is no longer interested
+	stopOnce sync.Once
 }
 
+// NewFileChanges returns a group of channels, each buffering a single
+// pending notification so that none is lost while the receiver is
+// busy. Repeated notifications of the same kind pending between two
+// reads collapse into one, but kinds never mask each other while the
+// channels are open: a burst of modifications cannot cause a deletion
+// or truncation to be missed. See Close for closed channels.
 func NewFileChanges() *FileChanges {
 	return &FileChanges{
-		make(chan bool), make(chan bool), make(chan bool)}
+		Modified:  make(chan bool, 1),
+		Truncated: make(chan bool, 1),
+		Deleted:   make(chan bool, 1),
+		Renamed:   make(chan bool, 1),
+		stopping:  make(chan struct{})}
+}
+
+// Stop tells the watcher reporting on these changes to stop and
+// release its resources. It may be called more than once.
+func (fc *FileChanges) Stop() {
+	fc.stopOnce.Do(func() { close(fc.stopping) })
+}
+
+// Stopping returns a channel that is closed once Stop has been called.
+// Watchers must stop reporting changes when it is closed.
+func (fc *FileChanges) Stopping() <-chan struct{} {
+	return fc.stopping
 }
 
 func (fc *FileChanges) NotifyModified() {
@@ -23,10 +53,21 @@ func (fc *FileChanges) NotifyDeleted() {
 	sendOnlyIfEmpty(fc.Deleted)
 }
 
+func (fc *FileChanges) NotifyRenamed() {
+	sendOnlyIfEmpty(fc.Renamed)
+}
+
+// Close closes the channels, for receivers ranging over them to end.
+// A receive from a closed channel is no notification, yet is always
+// ready, so a receiver selecting over several of them must tell it
+// apart, lest it mask the notifications of other kinds. The watchers
+// of this package leave them open: a deletion or rename is the last
+// change they report.
 func (fc *FileChanges) Close() {
 	close(fc.Modified)
 	close(fc.Truncated)
 	close(fc.Deleted)
+	close(fc.Renamed)
 }
 
 // sendOnlyIfEmpty sends on a bool channel only if the channel has no
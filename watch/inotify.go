@@ -3,42 +3,111 @@
 package watch
 
 import (
+	"errors"
 	"github.com/howeyc/fsnotify"
 	"os"
 	"path/filepath"
-	"launchpad.net/tomb"
+	"time"
+	"gopkg.in/tomb.v1"
 )
 
 // InotifyFileWatcher uses inotify to monitor file changes.
 type InotifyFileWatcher struct {
 	Filename string
 	Size     int64
+
+	// CheckInterval is how often the file is checked for changes no
+	// event was received for, by default defaultCheckInterval: the
+	// path is to still lead to the file watched, which is otherwise
+	// reported renamed, as happens on the copy-up of a file of
+	// overlayfs, and its size to be as last seen, which it is not once
+	// events were dropped on an overflow of the inotify queue. The path
+	// is checked on each modification regardless.
+	CheckInterval time.Duration
+}
+
+// defaultCheckInterval is how often the file is checked for changes
+// no event was received for, unless CheckInterval is set.
+const defaultCheckInterval = time.Second
+
+// NewInotifyFileWatcher returns a watcher for filename. The error is
+// always nil, as inotify resources are only acquired by ChangeEvents,
+// which fails once the per-user limits on them are reached.
+func NewInotifyFileWatcher(filename string) (*InotifyFileWatcher, error) {
+	fw := &InotifyFileWatcher{Filename: filename}
+	return fw, nil
+}
+
+func (fw *InotifyFileWatcher) BlockUntilExists(t *tomb.Tomb) error {
+	return fw.blockUntilExists(t, nil)
 }
 
-func NewInotifyFileWatcher(filename string) *InotifyFileWatcher {
-	fw := &InotifyFileWatcher{filename, 0}
-	return fw
+// BlockUntilExistsTimeout is BlockUntilExists giving up with
+// ErrWaitTimeout after d, if positive.
+func (fw *InotifyFileWatcher) BlockUntilExistsTimeout(t *tomb.Tomb, d time.Duration) error {
+	if d <= 0 {
+		return fw.BlockUntilExists(t)
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	return fw.blockUntilExists(t, timer.C)
 }
 
-func (fw *InotifyFileWatcher) BlockUntilExists(t tomb.Tomb) error {
+// blockUntilExists waits for the file to exist, watching its parent
+// directory, or the closest one that exists, until timeout fires,
+// never if nil.
+func (fw *InotifyFileWatcher) blockUntilExists(t *tomb.Tomb, timeout <-chan time.Time) error {
+	for {
+		err := blockUntilExists(fw.Filename, t, timeout)
+		if err == errWatchAgain {
+			continue
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+
+		// The parent directory is missing as well; wait for it to
+		// be created before watching it.
+		dirname := filepath.Dir(fw.Filename)
+		if dirname == fw.Filename {
+			return err
+		}
+		sub := &InotifyFileWatcher{Filename: dirname}
+		if err := sub.blockUntilExists(t, timeout); err != nil {
+			return err
+		}
+	}
+}
+
+// errWatchAgain is returned by blockUntilExists when the file was
+// deleted, as fsnotify then drops the creation of the file if it is
+// read along with the deletion. Watching with a new watcher does not
+// miss it.
+var errWatchAgain = errors.New("watch again")
+
+// blockUntilExists waits for filename to be created in its parent
+// directory, which must exist, until timeout fires.
+func blockUntilExists(filename string, t *tomb.Tomb, timeout <-chan time.Time) error {
 	w, err := fsnotify.NewWatcher()
 	if err != nil {
 		return err
 	}
 	defer w.Close()
 
-	dirname := filepath.Dir(fw.Filename)
+	dirname := filepath.Dir(filename)
 
-	// Watch for new files to be created in the parent directory.
-	err = w.WatchFlags(dirname, fsnotify.FSN_CREATE)
+	// Watch for new files to be created in the parent directory, and
+	// for the directory itself to go away, as happens when it is
+	// removed along with the file.
+	err = w.WatchFlags(dirname, fsnotify.FSN_CREATE|fsnotify.FSN_DELETE|fsnotify.FSN_RENAME)
 	if err != nil {
 		return err
 	}
-	defer w.RemoveWatch(filepath.Dir(fw.Filename))
+	defer w.RemoveWatch(dirname)
 
 	// Do a real check now as the file might have been created before
 	// calling `WatchFlags` above.
-	if _, err = os.Stat(fw.Filename); !os.IsNotExist(err) {
+	if _, err = os.Stat(filename); !os.IsNotExist(err) {
 		// file exists, or stat returned an error.
 		return err
 	}
@@ -46,26 +115,48 @@ func (fw *InotifyFileWatcher) BlockUntilExists(t tomb.Tomb) error {
 	for {
 		select {
 		case evt := <-w.Event:
-			if evt.Name == fw.Filename {
+			switch {
+			case evt.Name == filename && evt.IsCreate():
 				return nil
+			case evt.Name == filename && evt.IsDelete():
+				return errWatchAgain
+			case evt.Name == dirname && (evt.IsDelete() || evt.IsRename()):
+				return &os.PathError{Op: "watch", Path: dirname, Err: os.ErrNotExist}
 			}
+		case <-timeout:
+			return ErrWaitTimeout
 		case <-t.Dying():
 			return tomb.ErrDying
 		}
 	}
-	panic("unreachable")
 }
 
-func (fw *InotifyFileWatcher) ChangeEvents(t tomb.Tomb, fi os.FileInfo) *FileChanges {
+func (fw *InotifyFileWatcher) ChangeEvents(t *tomb.Tomb, fi os.FileInfo) (*FileChanges, error) {
 	changes := NewFileChanges()
 	
 	w, err := fsnotify.NewWatcher()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	err = w.Watch(fw.Filename)
+	if os.IsNotExist(err) {
+		// The file is gone already, as happens when it is created and
+		// deleted again in quick succession.
+		w.Close()
+		changes.NotifyDeleted()
+		return changes, nil
+	} else if err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	// No event is triggered on the file itself when it is deleted
+	// while still open, so watch its parent directory as well.
+	dirname := filepath.Dir(fw.Filename)
+	err = w.WatchFlags(dirname, fsnotify.FSN_DELETE|fsnotify.FSN_RENAME)
 	if err != nil {
-		panic(err)
+		w.Close()
+		return nil, err
 	}
 
 	fw.Size = fi.Size()
@@ -73,8 +164,22 @@ func (fw *InotifyFileWatcher) ChangeEvents(t tomb.Tomb, fi os.FileInfo) *FileCha
 	go func() {
 		defer w.Close()
 		defer w.RemoveWatch(fw.Filename)
-		defer changes.Close()
+		defer w.RemoveWatch(dirname)
+
+		// The file may have been replaced before the watch was
+		// registered, in which case no event is to come about fi.
+		if fw.replaced(fi, changes) {
+			return
+		}
+
+		interval := fw.CheckInterval
+		if interval <= 0 {
+			interval = defaultCheckInterval
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
 
+		filename := filepath.Clean(fw.Filename)
 		for {
 			prevSize := fw.Size
 
@@ -82,25 +187,53 @@ func (fw *InotifyFileWatcher) ChangeEvents(t tomb.Tomb, fi os.FileInfo) *FileCha
 
 			select {
 			case evt = <-w.Event:
+			case <-w.Error:
+				if !fw.resync(w, fi, changes) {
+					return
+				}
+				continue
+			case <-ticker.C:
+				if !fw.check(w, fi, changes) {
+					return
+				}
+				continue
 			case <-t.Dying():
 				return
+			case <-changes.Stopping():
+				return
+			}
+
+			if filepath.Clean(evt.Name) != filename {
+				// Event on another file in the directory.
+				continue
 			}
 
 			switch {
 			case evt.IsDelete():
-				fallthrough
+				changes.NotifyDeleted()
+				return
 
 			case evt.IsRename():
-				changes.NotifyDeleted()
+				changes.NotifyRenamed()
 				return
 
 			case evt.IsModify():
-				fi, err := os.Stat(fw.Filename)
-				if err != nil {
+				cur, err := os.Stat(fw.Filename)
+				if os.IsNotExist(err) {
+					// Deleted since; the event on the
+					// directory may not have been read yet.
+					changes.NotifyDeleted()
+					return
+				} else if err != nil {
 					// XXX: no panic here
 					panic(err)
 				}
-				fw.Size = fi.Size()
+				if !os.SameFile(fi, cur) {
+					// Replaced without an event.
+					changes.NotifyRenamed()
+					return
+				}
+				fw.Size = cur.Size()
 
 				if prevSize > 0 && prevSize > fw.Size {
 					changes.NotifyTruncated()
@@ -112,5 +245,64 @@ func (fw *InotifyFileWatcher) ChangeEvents(t tomb.Tomb, fi os.FileInfo) *FileCha
 		}
 	}()
 
-	return changes
+	return changes, nil
+}
+
+// replaced reports whether the path no longer leads to fi, the file
+// watched, having notified of its deletion or renaming if so.
+func (fw *InotifyFileWatcher) replaced(fi os.FileInfo, changes *FileChanges) bool {
+	cur, err := os.Stat(fw.Filename)
+	switch {
+	case os.IsNotExist(err):
+		changes.NotifyDeleted()
+		return true
+	case err == nil && !os.SameFile(fi, cur):
+		changes.NotifyRenamed()
+		return true
+	}
+	return false
+}
+
+// check looks for changes to the file no event was received for, to
+// resync if any. As fsnotify drops IN_Q_OVERFLOW events itself, for
+// naming no file, this is how an overflow of the inotify queue is
+// recovered from. It returns false once watching must end.
+func (fw *InotifyFileWatcher) check(w *fsnotify.Watcher, fi os.FileInfo, changes *FileChanges) bool {
+	cur, err := os.Stat(fw.Filename)
+	if err == nil && os.SameFile(fi, cur) && cur.Size() == fw.Size {
+		return true
+	}
+	return fw.resync(w, fi, changes)
+}
+
+// resync recovers from events having possibly been lost, as signaled
+// by an error from inotify, such as a failed read of its queue, or
+// found by check. The file is compared to fi, what it was when
+// watching began, to notify of any change, and its watch is registered
+// anew. It returns false once the file is gone, in which case
+// watching must end.
+func (fw *InotifyFileWatcher) resync(w *fsnotify.Watcher, fi os.FileInfo, changes *FileChanges) bool {
+	cur, err := os.Stat(fw.Filename)
+	switch {
+	case os.IsNotExist(err):
+		changes.NotifyDeleted()
+		return false
+	case err != nil:
+		return true
+	case !os.SameFile(fi, cur):
+		changes.NotifyRenamed()
+		return false
+	case cur.Size() < fw.Size:
+		changes.NotifyTruncated()
+	default:
+		changes.NotifyModified()
+	}
+	fw.Size = cur.Size()
+
+	w.RemoveWatch(fw.Filename)
+	if err := w.Watch(fw.Filename); err != nil {
+		changes.NotifyDeleted()
+		return false
+	}
+	return true
 }
@@ -3,8 +3,14 @@
 package watch
 
 import (
-	"launchpad.net/tomb"
+	"gopkg.in/tomb.v1"
+	"hash/fnv"
+	"io"
+	"io/fs"
 	"os"
+	"reflect"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -12,35 +18,170 @@ import (
 type PollingFileWatcher struct {
 	Filename string
 	Size     int64
+	Clock    Clock // Time source for the poll interval
+	FS       fs.FS // If set, the file is looked up in it instead of the OS
+
+	// HashSize, if positive, is the number of bytes at the end of the
+	// file hashed on each poll, for changes leaving its size and
+	// modification time as they were to be reported as well, such as
+	// those made within the same second on file systems keeping
+	// modification times to the second.
+	HashSize int
+
+	// MinInterval and MaxInterval, if both positive, have the poll
+	// interval adapt to the activity of the file: it starts as set
+	// by SetInterval, and is halved on each poll finding changes,
+	// down to MinInterval, and doubled on each finding none, up to
+	// MaxInterval.
+	MinInterval time.Duration
+	MaxInterval time.Duration
+
+	interval atomic.Int64 // Set by SetInterval, or zero
+	current  atomic.Int64 // Interval until the next poll, once watching
+}
+
+// NewPollingFileWatcher returns a watcher polling filename. The error
+// is always nil, polling requiring no resources up front.
+func NewPollingFileWatcher(filename string) (*PollingFileWatcher, error) {
+	fw := &PollingFileWatcher{Filename: filename, Clock: RealClock}
+	return fw, nil
 }
 
-func NewPollingFileWatcher(filename string) *PollingFileWatcher {
-	fw := &PollingFileWatcher{filename, 0}
-	return fw
+// SetInterval changes how often the file is polled, from the next poll
+// on; zero restores POLL_DURATION. It is safe to call while the file
+// is being watched.
+func (fw *PollingFileWatcher) SetInterval(d time.Duration) {
+	fw.interval.Store(int64(d))
+}
+
+// Interval returns the interval until the next poll of the file, as
+// adapted per MinInterval and MaxInterval, or zero if it is not being
+// watched yet. It is safe to call while the file is being watched.
+func (fw *PollingFileWatcher) Interval() time.Duration {
+	return time.Duration(fw.current.Load())
+}
+
+// stat returns the FileInfo of the file, looked up in FS if set.
+func (fw *PollingFileWatcher) stat() (os.FileInfo, error) {
+	if fw.FS != nil {
+		return fs.Stat(fw.FS, fw.Filename)
+	}
+	return os.Stat(fw.Filename)
+}
+
+// open opens the file, looked up in FS if set.
+func (fw *PollingFileWatcher) open() (fs.File, error) {
+	if fw.FS != nil {
+		return fw.FS.Open(fw.Filename)
+	}
+	return os.Open(fw.Filename)
+}
+
+// hash returns a hash of the last HashSize bytes of the file, given
+// its size, or 0 if they cannot be read.
+func (fw *PollingFileWatcher) hash(size int64) uint64 {
+	if fw.HashSize <= 0 {
+		return 0
+	}
+	f, err := fw.open()
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	r, ok := f.(io.ReaderAt)
+	if !ok {
+		return 0
+	}
+	n := min(int64(fw.HashSize), size)
+	buf := make([]byte, n)
+	if _, err := r.ReadAt(buf, size-n); err != nil {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write(buf)
+	return h.Sum64()
+}
+
+// sameFile reports whether fi1 and fi2 describe the same file. Those
+// of the OS are compared with os.SameFile. Others are told apart by
+// what their Sys method returns, when comparable and not nil, and
+// otherwise assumed to be the same.
+func sameFile(fi1, fi2 os.FileInfo) bool {
+	sys1, sys2 := fi1.Sys(), fi2.Sys()
+	if _, ok := sys1.(*syscall.Stat_t); ok {
+		return os.SameFile(fi1, fi2)
+	}
+	if sys1 == nil || sys2 == nil || !reflect.TypeOf(sys1).Comparable() {
+		return true
+	}
+	return sys1 == sys2
+}
+
+// pollInterval returns how often the file is polled.
+func (fw *PollingFileWatcher) pollInterval() time.Duration {
+	if d := fw.interval.Load(); d > 0 {
+		return time.Duration(d)
+	}
+	return POLL_DURATION
+}
+
+// nextInterval returns the interval until the next poll, given that
+// until the last one, or zero if none, and whether it found changes.
+func (fw *PollingFileWatcher) nextInterval(prev time.Duration, changed bool) time.Duration {
+	if fw.MinInterval <= 0 || fw.MaxInterval <= 0 {
+		return fw.pollInterval()
+	}
+	d := fw.pollInterval()
+	if prev > 0 && changed {
+		d = prev / 2
+	} else if prev > 0 {
+		d = prev * 2
+	}
+	return max(fw.MinInterval, min(d, fw.MaxInterval))
 }
 
 var POLL_DURATION time.Duration
 
-func (fw *PollingFileWatcher) BlockUntilExists(t tomb.Tomb) error {
+// BlockUntilExists polls for the file to exist. A missing parent
+// directory needs no special care, as it makes the file appear missing
+// too until the directory is recreated.
+func (fw *PollingFileWatcher) BlockUntilExists(t *tomb.Tomb) error {
+	return fw.blockUntilExists(t, nil)
+}
+
+// BlockUntilExistsTimeout is BlockUntilExists giving up with
+// ErrWaitTimeout after d, if positive, as measured by Clock.
+func (fw *PollingFileWatcher) BlockUntilExistsTimeout(t *tomb.Tomb, d time.Duration) error {
+	var timeout <-chan time.Time
+	if d > 0 {
+		timeout = fw.Clock.After(d)
+	}
+	return fw.blockUntilExists(t, timeout)
+}
+
+// blockUntilExists polls for the file to exist until timeout fires,
+// never if nil.
+func (fw *PollingFileWatcher) blockUntilExists(t *tomb.Tomb, timeout <-chan time.Time) error {
 	for {
-		if _, err := os.Stat(fw.Filename); err == nil {
+		if _, err := fw.stat(); err == nil {
 			return nil
 		} else if !os.IsNotExist(err) {
 			return err
 		}
 		select {
-		case <-time.After(POLL_DURATION):
+		case <-fw.Clock.After(fw.pollInterval()):
 			continue
+		case <-timeout:
+			return ErrWaitTimeout
 		case <-t.Dying():
 			return tomb.ErrDying
 		}
 	}
-	panic("unreachable")
 }
 
-func (fw *PollingFileWatcher) ChangeEvents(t tomb.Tomb, origFi os.FileInfo) *FileChanges {
+func (fw *PollingFileWatcher) ChangeEvents(t *tomb.Tomb, origFi os.FileInfo) (*FileChanges, error) {
 	changes := NewFileChanges()
-	var prevModTime time.Time
+	prevModTime := origFi.ModTime()
 
 	// XXX: use tomb.Tomb to cleanly manage these goroutines. replace
 	// the panic (below) with tomb's Kill.
@@ -48,18 +189,24 @@ func (fw *PollingFileWatcher) ChangeEvents(t tomb.Tomb, origFi os.FileInfo) *Fil
 	fw.Size = origFi.Size()
 
 	go func() {
-		defer changes.Close()
-		
 		prevSize := fw.Size
+		prevHash := fw.hash(prevSize)
+		var interval time.Duration
+		changed := false
 		for {
+			interval = fw.nextInterval(interval, changed)
+			// Stored once the poll is pending, as Interval tells.
+			tick := fw.Clock.After(interval)
+			fw.current.Store(int64(interval))
+			changed = false
 			select {
+			case <-tick:
 			case <-t.Dying():
 				return
-			default:
+			case <-changes.Stopping():
+				return
 			}
-
-			time.Sleep(POLL_DURATION)
-			fi, err := os.Stat(fw.Filename)
+			fi, err := fw.stat()
 			if err != nil {
 				if os.IsNotExist(err) {
 					// File does not exist (has been deleted).
@@ -71,8 +218,8 @@ func (fw *PollingFileWatcher) ChangeEvents(t tomb.Tomb, origFi os.FileInfo) *Fil
 			}
 
 			// File got moved/renamed?
-			if !os.SameFile(origFi, fi) {
-				changes.NotifyDeleted()
+			if !sameFile(origFi, fi) {
+				changes.NotifyRenamed()
 				return
 			}
 
@@ -81,20 +228,28 @@ func (fw *PollingFileWatcher) ChangeEvents(t tomb.Tomb, origFi os.FileInfo) *Fil
 			if prevSize > 0 && prevSize > fw.Size {
 				changes.NotifyTruncated()
 				prevSize = fw.Size
+				prevHash = fw.hash(fw.Size)
+				changed = true
 				continue
 			}
+			grown := fw.Size > prevSize
 			prevSize = fw.Size
 
-			// File was appended to (changed)?
+			// File was appended to (changed)? Growth is checked
+			// as well, for file systems not keeping track of
+			// modification times.
 			modTime := fi.ModTime()
-			if modTime != prevModTime {
+			hash := fw.hash(fw.Size)
+			if modTime != prevModTime || grown || hash != prevHash {
 				prevModTime = modTime
 				changes.NotifyModified()
+				changed = true
 			}
+			prevHash = hash
 		}
 	}()
 
-	return changes
+	return changes, nil
 }
 
 func init() {
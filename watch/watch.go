@@ -3,19 +3,74 @@
 package watch
 
 import (
+	"errors"
 	"os"
-	"launchpad.net/tomb"
+	"time"
+	"gopkg.in/tomb.v1"
 )
 
-// FileWatcher monitors file-level events.
+// ErrWaitTimeout is returned by BlockUntilExistsTimeout when the file
+// was not created within the timeout.
+var ErrWaitTimeout = errors.New("timed out waiting for file to exist")
+
+// FileWatcher monitors file-level events. It is a stable interface:
+// besides the inotify and polling implementations provided by this
+// package, custom implementations may be supplied to the tail package
+// via `Config.WatcherFactory`.
+//
+// Both methods are passed the tomb of the tail, and must give up
+// waiting or reporting once it is dying. The tomb is shared by pointer,
+// as a copy may not see it dying.
 type FileWatcher interface {
-	// BlockUntilExists blocks until the file comes into existence.
-	BlockUntilExists(tomb.Tomb) error
+	// BlockUntilExists blocks until the file comes into existence, or
+	// returns tomb.ErrDying once the tomb is dying.
+	BlockUntilExists(*tomb.Tomb) error
 
 	// ChangeEvents reports on changes to a file, be it modification,
-	// deletion, renames or truncations. Returned FileChanges group of
-	// channels will be closed, thus become unusable, after a deletion
-	// or truncation event.
-	ChangeEvents(tomb.Tomb, os.FileInfo) *FileChanges
+	// deletion, renames or truncations. A deletion or rename event is
+	// the last reported on the returned FileChanges, whose channels are
+	// left open, as a closed one would be taken for an event. It fails
+	// if the file cannot be watched, such as once out of inotify
+	// instances or watches.
+	ChangeEvents(*tomb.Tomb, os.FileInfo) (*FileChanges, error)
+}
+
+
+// timeoutBlocker is implemented by watchers bounding the wait for the
+// file to exist themselves.
+type timeoutBlocker interface {
+	BlockUntilExistsTimeout(*tomb.Tomb, time.Duration) error
 }
 
+// BlockUntilExistsTimeout is like fw.BlockUntilExists, but gives up
+// waiting with ErrWaitTimeout after d, if positive. The watchers of
+// this package bound the wait themselves; for others, the wait is
+// ended by way of a tomb dying at the timeout.
+func BlockUntilExistsTimeout(fw FileWatcher, t *tomb.Tomb, d time.Duration) error {
+	if tb, ok := fw.(timeoutBlocker); ok {
+		return tb.BlockUntilExistsTimeout(t, d)
+	}
+	if d <= 0 {
+		return fw.BlockUntilExists(t)
+	}
+
+	var deadline tomb.Tomb
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-timer.C:
+			deadline.Kill(ErrWaitTimeout)
+		case <-t.Dying():
+			deadline.Kill(nil)
+		case <-done:
+		}
+	}()
+	err := fw.BlockUntilExists(&deadline)
+	if err == tomb.ErrDying && deadline.Err() == ErrWaitTimeout {
+		return ErrWaitTimeout
+	}
+	return err
+}